@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// extractMember returns the content of the member name of archive, which is
+// a zip or a tar, plain or compressed with gzip or bzip2, told apart by its
+// content. name is matched ignoring a leading "./" and a leading "/".
+func extractMember(archive []byte, name string) ([]byte, error) {
+	name = cleanMemberName(name)
+	switch {
+	case bytes.HasPrefix(archive, []byte("PK\x03\x04")), bytes.HasPrefix(archive, []byte("PK\x05\x06")):
+		return extractZipMember(archive, name)
+	case bytes.HasPrefix(archive, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip: %w", err)
+		}
+		return extractTarMember(gz, name)
+	case bytes.HasPrefix(archive, []byte("BZh")):
+		return extractTarMember(bzip2.NewReader(bytes.NewReader(archive)), name)
+	case len(archive) > 262 && string(archive[257:262]) == "ustar":
+		return extractTarMember(bytes.NewReader(archive), name)
+	}
+	return nil, errors.New("'extract': unsupported archive type, expected zip, tar, tar.gz or tar.bz2")
+}
+
+func cleanMemberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(name, "./")), "/")
+}
+
+func extractZipMember(archive []byte, name string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, fmt.Errorf("reading zip: %w", err)
+	}
+	for _, f := range zr.File {
+		if cleanMemberName(f.Name) != name || f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s from zip: %w", name, err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("'extract': no file %s in zip", name)
+}
+
+func extractTarMember(r io.Reader, name string) ([]byte, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("'extract': no file %s in tar", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+		if cleanMemberName(hdr.Name) == name && hdr.Typeflag == tar.TypeReg {
+			return io.ReadAll(tr)
+		}
+	}
+}
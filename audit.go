@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// runAudit lists every .upd file below projectRoot with whether its source
+// is fetched securely and whether its content is pinned by a sha256, without
+// any network access. With -strict the exit code is 1 if any is insecure or
+// unpinned.
+func runAudit(projectRoot string, args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "Exit non-zero if any source is insecure or unpinned")
+	fs.Parse(args)
+
+	updPaths, err := findUpdFiles(projectRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		return 1
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "FILE\tSCHEME\tPIN\tURL\n")
+	for _, updPath := range updPaths {
+		rel, err := filepath.Rel(projectRoot, updPath)
+		if err != nil {
+			rel = updPath
+		}
+		upd, err := loadUpdFile(updPath)
+		if err != nil {
+			fmt.Fprintf(w, "%s\terror\t-\t%v\n", rel, err)
+			failed = true
+			continue
+		}
+
+		scheme := "insecure"
+		if isSecureSource(upd) {
+			scheme = "secure"
+		}
+		pin := "unpinned"
+		if upd.Sha256 != "" {
+			pin = "pinned"
+		}
+		if scheme != "secure" || pin != "pinned" {
+			failed = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", rel, scheme, pin, upd.URL)
+	}
+	w.Flush()
+
+	if *strict && failed {
+		return 1
+	}
+	return 0
+}
+
+// isSecureSource reports whether upd is fetched in a way that can't be
+// tampered with in transit: https, a local file, or a local unix socket
+func isSecureSource(upd UpdFile) bool {
+	u, err := url.Parse(upd.URL)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https", "file":
+		return true
+	case "http":
+		return upd.UnixSocket != ""
+	}
+	return false
+}
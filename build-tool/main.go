@@ -1,8 +1,11 @@
 package main
 
-// Go Build Tool v0.5 (2025-07-28) (755a3c7609f9d349)
+// Go Build Tool v0.5 (2025-07-28) (755a3c7609f9d349), with local changes
 // https://github.com/mrvnmyr/go-build-tool
 //
+// This copy has diverged from v0.5 (see the git history of this file), so
+// it's no longer updated by upd, upstream changes have to be merged by hand.
+//
 // This is a simple standalone binary that builds the actual project.
 //
 // You could do the same thing with OS specific shell scripts, but we want to be
@@ -19,19 +22,47 @@ package main
 // To see all supported options/CLI flags, run:
 //
 // $ go run ./build-tool/main.go -h
+//
+// After a successful build, 'bin/SHA256SUMS' lists the binaries built by it
+// for 'sha256sum -c'.
+//
+//
+// HOOKS
+//
+// An executable 'build-hook-pre.sh' ('.bat' on windows) in the project root
+// is run before building, 'build-hook-post.sh' after all builds succeeded.
+// The post hook gets these environment variables:
+//
+//	BUILD_TOOL_BIN_DIR      absolute path of the directory binaries are built into
+//	BUILD_TOOL_BIN_NAME     bin name including -name-suffix, e.g. "upd-debug"
+//	BUILD_TOOL_CURRENT_BIN  absolute path of the binary built for the current
+//	                        platform, empty if there's none (e.g. -check-only)
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf16"
 )
 
 const CONFIG_FILE_NAME = "build-tool-config.json"
@@ -42,12 +73,26 @@ var (
 )
 
 var (
-	flagBuildAll  = false
-	flagDebug     = false
-	flagNoGoGet   = false
-	flagNoSymlink = false
-	configPath    = ""
-	config        BuildConfig
+	flagAdaptive     = false
+	flagAtomic       = false
+	flagBuildAll     = false
+	flagCheckOnly    = false
+	flagDebug        = false
+	flagGHAnnotate   = os.Getenv("GITHUB_ACTIONS") == "true"
+	flagGoflags      = ""
+	flagNoGoGet      = false
+	flagNoSymlink    = false
+	flagNoVersion    = false
+	flagPrintConfig  = false
+	flagProfile      = ""
+	flagReport       = false
+	flagReproducible = false
+	flagRun          = false
+	flagUpload       = false
+	flagSplitDebug   = false
+	flagSuffix       = ""
+	configPath       = ""
+	config           BuildConfig
 
 	currentBinPath = ""
 )
@@ -55,7 +100,277 @@ var (
 type BuildConfig struct {
 	BinName   string            `json:"binName"`
 	Env       map[string]string `json:"env"`
-	Platforms [][]string        `json:"platforms"`
+	Platforms []Platform        `json:"platforms"`
+
+	// Goflags end up in $GOFLAGS of 'go get' and 'go build', after a GOFLAGS
+	// of Env and before -goflags (later flags win)
+	Goflags string `json:"goflags"`
+
+	// Ldflags are passed to 'go build -ldflags' for every platform, unless
+	// one overrides them (see Platform.Ldflags)
+	Ldflags string `json:"ldflags"`
+
+	// SplitDebug is the same as always passing -split-debug
+	SplitDebug bool `json:"splitDebug"`
+
+	// VersionVars maps fully qualified string variables, e.g.
+	// "github.com/me/app/internal/buildinfo.Commit" or "main.version", to
+	// what is injected into them via -ldflags -X: "version" (git describe),
+	// "commit" (git rev-parse HEAD), "date" (build time, RFC 3339 UTC) or
+	// "stamp" (both version and date, e.g. "v1.2.0-3-gabc1234 2025-07-28T10:00:00Z").
+	// What git can't tell (e.g. no repository) is set to "unknown".
+	VersionVars map[string]string `json:"versionVars"`
+
+	// Windows, if set, is embedded into windows binaries as version info
+	// resource plus icon, so Explorer shows proper file properties
+	Windows *WindowsConfig `json:"windows"`
+
+	// Upload is where -upload sends the built binaries
+	Upload *UploadConfig `json:"upload"`
+
+	// Profiles name subsets of Platforms to build via -profile, e.g.
+	// {"embedded": ["linux/arm", "linux/arm64"]}. An entry is "goos/goarch",
+	// matching all of its GOARM builds, or "goos/armvN" for a single one.
+	Profiles map[string][]string `json:"profiles"`
+
+	// SymlinkName is what the symlink to the current platform's binary is
+	// called, e.g. "app" (default: BinName)
+	SymlinkName string `json:"symlinkName"`
+}
+
+// WindowsConfig is the version info resource of windows binaries
+type WindowsConfig struct {
+	Icon        string `json:"icon"` // .ico file, relative to the project root
+	CompanyName string `json:"companyName"`
+	ProductName string `json:"productName"`
+	Version     string `json:"version"` // e.g. "1.2.3" or "1.2.3.4"
+}
+
+// UploadConfig describes where -upload PUTs every built binary
+type UploadConfig struct {
+	// Method is "put" (a plain HTTP PUT) or "s3" (a PUT signed with AWS
+	// SigV4, credentials from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY
+	// and optionally $AWS_SESSION_TOKEN)
+	Method string `json:"method"`
+
+	// URL of each binary, "{file}", "{goos}", "{goarch}", "{goarm}" and
+	// "{binName}" are replaced, e.g. "https://bucket.s3.amazonaws.com/releases/{file}"
+	URL string `json:"url"`
+
+	// Region is the S3 region (default: $AWS_REGION, else "us-east-1")
+	Region string `json:"region"`
+
+	// Headers are sent along with every upload, e.g. for authentication
+	Headers map[string]string `json:"headers"`
+}
+
+// Platform is a single build target. In the config it's either a plain
+// ["goos", "goarch"] pair or an object with additional settings:
+//
+//	{"goos": "linux", "goarch": "arm64", "weight": 2}
+type Platform struct {
+	GOOS   string `json:"goos"`
+	GOARCH string `json:"goarch"`
+
+	// Weight is how many of the parallel build workers this target occupies
+	// while building, e.g. for memory hungry cgo targets (default: 1)
+	Weight int `json:"weight"`
+
+	// Ldflags are added to the global ldflags for this target only, e.g.
+	// "-H windowsgui". With LdflagsMode "replace" they are used instead of
+	// the global ones (default: "append").
+	Ldflags     string `json:"ldflags"`
+	LdflagsMode string `json:"ldflagsMode"`
+
+	// GOARM lists the ARM versions to build for a goarch "arm" target,
+	// e.g. ["5", "6", "7"], each becomes its own "<bin>_linux_armv7" build
+	GOARM []string `json:"goarm"`
+}
+
+// expandPlatforms returns platforms with every GOARM value being its own
+// Platform, so each of them has at most one
+func expandPlatforms(platforms []Platform) []Platform {
+	var expanded []Platform
+	for _, p := range platforms {
+		if len(p.GOARM) <= 1 {
+			expanded = append(expanded, p)
+			continue
+		}
+		for _, goarm := range p.GOARM {
+			variant := p
+			variant.GOARM = []string{goarm}
+			expanded = append(expanded, variant)
+		}
+	}
+	return expanded
+}
+
+// name is what tells the builds of p apart, e.g. "linux/amd64" or
+// "linux/armv7" for one of the GOARM builds of an expanded platform
+func (p Platform) name() string {
+	arch := strings.ToLower(p.GOARCH)
+	if len(p.GOARM) == 1 {
+		arch += "v" + p.GOARM[0]
+	}
+	return strings.ToLower(p.GOOS) + "/" + arch
+}
+
+// inProfile tells whether the (expanded) platform p is selected by the
+// entries of a profile, see BuildConfig.Profiles
+func (p Platform) inProfile(entries []string) bool {
+	for _, e := range entries {
+		e = strings.ToLower(e)
+		if e == p.name() || e == strings.ToLower(p.GOOS+"/"+p.GOARCH) {
+			return true
+		}
+	}
+	return false
+}
+
+// ldflags returns the -ldflags from the config for p
+func (p Platform) ldflags() []string {
+	var ldflags []string
+	if config.Ldflags != "" && p.LdflagsMode != "replace" {
+		ldflags = append(ldflags, config.Ldflags)
+	}
+	if p.Ldflags != "" {
+		ldflags = append(ldflags, p.Ldflags)
+	}
+	return ldflags
+}
+
+func (p *Platform) UnmarshalJSON(data []byte) error {
+	var pair []string
+	if err := json.Unmarshal(data, &pair); err == nil {
+		if len(pair) < 2 {
+			return fmt.Errorf("platform %s must have a GOOS and a GOARCH", data)
+		}
+		p.GOOS, p.GOARCH = pair[0], pair[1]
+		return nil
+	}
+
+	type plain Platform // avoid recursing into UnmarshalJSON
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	if p.GOOS == "" || p.GOARCH == "" {
+		return fmt.Errorf("platform %s must have a goos and a goarch", data)
+	}
+	if len(p.GOARM) > 0 && strings.ToLower(p.GOARCH) != "arm" {
+		return fmt.Errorf("platform %s: goarm requires goarch arm", data)
+	}
+	if m := p.LdflagsMode; m != "" && m != "append" && m != "replace" {
+		return fmt.Errorf("platform %s: ldflagsMode must be append or replace", data)
+	}
+	return nil
+}
+
+// weightedSemaphore limits the summed weight of everything holding it at once
+type weightedSemaphore struct {
+	cond     *sync.Cond
+	capacity int
+	limit    int // <= capacity, lowered by -adaptive under load
+	used     int
+}
+
+func newWeightedSemaphore(capacity int) *weightedSemaphore {
+	return &weightedSemaphore{cond: sync.NewCond(&sync.Mutex{}), capacity: capacity, limit: capacity}
+}
+
+// Acquire blocks until weight fits and returns the weight actually taken,
+// which is clamped to [1, capacity] so anything can run eventually. If
+// nothing holds the semaphore, any weight fits.
+func (s *weightedSemaphore) Acquire(weight int) int {
+	weight = max(1, min(weight, s.capacity))
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	for s.used > 0 && s.used+weight > s.limit {
+		s.cond.Wait()
+	}
+	s.used += weight
+	return weight
+}
+
+// SetLimit changes how much weight may be held at once, clamped to
+// [1, capacity]. Holders above a lowered limit aren't interrupted.
+func (s *weightedSemaphore) SetLimit(limit int) int {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	s.limit = max(1, min(limit, s.capacity))
+	s.cond.Broadcast()
+	return s.limit
+}
+
+func (s *weightedSemaphore) Limit() int {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.limit
+}
+
+// adaptLimit implements -adaptive: until done it checks the system load
+// every few seconds, dropping the limit of sem by one while the load is
+// above 1.5 per CPU and raising it again once it's below 1 per CPU
+func adaptLimit(sem *weightedSemaphore, done <-chan struct{}) {
+	if _, err := loadAverage(); err != nil {
+		debugf("-adaptive: no load average available (%v), using a fixed worker count\n", err)
+		return
+	}
+
+	cpus := float64(runtime.NumCPU())
+	debugf("-adaptive: starting with %d workers\n", sem.Limit())
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		load, err := loadAverage()
+		if err != nil {
+			continue
+		}
+		before := sem.Limit()
+		limit := before
+		switch {
+		case load > 1.5*cpus:
+			limit = sem.SetLimit(before - 1)
+		case load < cpus:
+			limit = sem.SetLimit(before + 1)
+		}
+		if limit != before {
+			debugf("-adaptive: load %.2f, now %d workers\n", load, limit)
+		}
+	}
+}
+
+// loadAverage returns the 1 minute load average of the system, where the OS
+// tells it (/proc/loadavg, else sysctl vm.loadavg)
+func loadAverage() (float64, error) {
+	var fields []string
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		fields = strings.Fields(string(data))
+	} else if out, err := exec.Command("sysctl", "-n", "vm.loadavg").Output(); err == nil {
+		fields = strings.Fields(strings.Trim(strings.TrimSpace(string(out)), "{}"))
+	}
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("can't determine the load average on %s", runtime.GOOS)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func (s *weightedSemaphore) Release(weight int) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	s.used -= weight
+	s.cond.Broadcast()
+}
+
+func (s *weightedSemaphore) Used() int {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.used
 }
 
 func check(err error) {
@@ -80,6 +395,545 @@ func isExecutable(path string) bool {
 	return mode.IsRegular() && (mode&0111 != 0)
 }
 
+// fileSizeAndSha256 returns the size and hex encoded sha256 of the file at path
+func fileSizeAndSha256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256SumsPath lists the sha256 of the binaries of the last successful
+// build, in the format of 'sha256sum -c'
+const sha256SumsPath = "bin/SHA256SUMS"
+
+// writeSha256Sums writes sha256SumsPath for the binaries at paths (which all
+// live in ./bin), sorted by name. It's written to a temporary file renamed
+// into place, so it's never partially written.
+func writeSha256Sums(paths []string) error {
+	names := map[string]string{} // file name -> sha256
+	for _, path := range paths {
+		_, sum, err := fileSizeAndSha256(path)
+		if err != nil {
+			return err
+		}
+		names[filepath.Base(path)] = sum
+	}
+
+	var b strings.Builder
+	for _, name := range sortedKeys(names) {
+		fmt.Fprintf(&b, "%s  %s\n", names[name], name)
+	}
+	tmp := sha256SumsPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sha256SumsPath)
+}
+
+// goBuildArgs returns the 'go build' command line writing to out, ldflags
+// being passed as a single -ldflags
+func goBuildArgs(out string, ldflags []string) []string {
+	args := []string{"go", "build"}
+	if flagReproducible {
+		// no absolute paths or VCS state in the binary, and a build ID that
+		// doesn't depend on the machine's toolchain cache
+		args = append(args, "-trimpath", "-buildvcs=false")
+		ldflags = append(ldflags, "-buildid=")
+	}
+	if len(ldflags) > 0 {
+		args = append(args, "-ldflags", strings.Join(ldflags, " "))
+	}
+	return append(args, "-o", out)
+}
+
+// uploadClient is used by uploadArtifact, the timeout covers a whole
+// upload, so it's generous enough for large binaries over slow links
+var uploadClient = &http.Client{Timeout: 10 * time.Minute}
+
+// uploadArtifact PUTs the binary at path to where config.Upload says
+func uploadArtifact(path string, env map[string]string) error {
+	target := strings.NewReplacer(
+		"{file}", filepath.Base(path),
+		"{goos}", env["GOOS"],
+		"{goarch}", env["GOARCH"],
+		"{goarm}", env["GOARM"],
+		"{binName}", config.BinName,
+	).Replace(config.Upload.URL)
+
+	_, sum, err := fileSizeAndSha256(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", target, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	for k, v := range config.Upload.Headers {
+		req.Header.Set(k, v)
+	}
+	if config.Upload.Method == "s3" {
+		if err := signS3Request(req, sum); err != nil {
+			return err
+		}
+	}
+
+	debugf("Uploading %s to %s...\n", path, target)
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PUT %s: %s %s", target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("Uploaded %s to %s\n", path, target)
+	return nil
+}
+
+// signS3Request adds an AWS Signature Version 4 to req, whose body has the
+// hex sha256 payloadHash
+func signS3Request(req *http.Request, payloadHash string) error {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("s3 upload requires $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	region := config.Upload.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	// every header set so far gets signed, plus host
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := sortedKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// send the path and query exactly as they're signed
+	req.URL.RawPath = s3EscapePath(req.URL.Path)
+	query, err := s3CanonicalQuery(req.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = query
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// s3EscapePath URI-encodes every byte of p but unreserved ones and '/', as
+// required for the canonical request of SigV4
+func s3EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return s3Escape(p, true)
+}
+
+// s3CanonicalQuery returns rawQuery the way the canonical request of SigV4
+// requires it, every name and value URI-encoded and sorted by name, then
+// value
+func s3CanonicalQuery(rawQuery string) (string, error) {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("parsing upload query: %w", err)
+	}
+	var pairs [][2]string
+	for name, vs := range values {
+		for _, v := range vs {
+			pairs = append(pairs, [2]string{s3Escape(name, false), s3Escape(v, false)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	var b strings.Builder
+	for i, pair := range pairs {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(pair[0] + "=" + pair[1])
+	}
+	return b.String(), nil
+}
+
+// s3Escape URI-encodes every byte of s but unreserved ones, and '/' if
+// keepSlash
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c == '/' && keepSlash) || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// COFF machine and IMAGE_REL_*_ADDR32NB relocation type per GOARCH, for
+// writeWindowsSyso
+var coffMachines = map[string][2]uint16{
+	"386":   {0x14c, 0x7},
+	"amd64": {0x8664, 0x3},
+	"arm":   {0x1c4, 0x2},
+	"arm64": {0xaa64, 0x2},
+}
+
+// windowsResource is a single entry of a resource section
+type windowsResource struct {
+	Type, ID uint16
+	Data     []byte
+}
+
+const (
+	rtIcon      = 3
+	rtGroupIcon = 14
+	rtVersion   = 16
+)
+
+// writeWindowsSyso writes a COFF object with a .rsrc section holding the
+// version info (and icon) of cfg to path, which the go toolchain links into
+// windows binaries of goarch. Everything is generated here, so no external
+// resource compiler is needed.
+func writeWindowsSyso(path, goarch, binFileName string, cfg WindowsConfig) error {
+	machine, ok := coffMachines[goarch]
+	if !ok {
+		return fmt.Errorf("windows resources are not supported for GOARCH %s", goarch)
+	}
+
+	versionInfo, err := windowsVersionInfo(cfg, binFileName)
+	if err != nil {
+		return err
+	}
+	resources := []windowsResource{{Type: rtVersion, ID: 1, Data: versionInfo}}
+	if cfg.Icon != "" {
+		icons, err := windowsIconResources(cfg.Icon)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, icons...)
+	}
+
+	section, relocs := windowsResourceSection(resources)
+	return os.WriteFile(path, coffObject(machine[0], machine[1], section, relocs), 0o644)
+}
+
+// parseWindowsVersion parses "1.2.3" (or "v1.2.3.4") into its 4 parts
+func parseWindowsVersion(v string) ([4]uint16, error) {
+	var parts [4]uint16
+	if v == "" {
+		return parts, nil
+	}
+	fields := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(fields) > 4 {
+		return parts, fmt.Errorf("invalid windows version %q: at most 4 parts", v)
+	}
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 16)
+		if err != nil {
+			return parts, fmt.Errorf("invalid windows version %q", v)
+		}
+		parts[i] = uint16(n)
+	}
+	return parts, nil
+}
+
+// utf16z returns s as null terminated UTF-16LE
+func utf16z(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return append(b, 0, 0)
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// versionInfoBlock builds one of the nested structures VS_VERSIONINFO is
+// made of: length, value length, type, key, value and children
+func versionInfoBlock(key string, typ uint16, value []byte, valueLen uint16, children ...[]byte) []byte {
+	b := make([]byte, 6)
+	binary.LittleEndian.PutUint16(b[2:], valueLen)
+	binary.LittleEndian.PutUint16(b[4:], typ)
+	b = pad4(append(b, utf16z(key)...))
+	b = append(b, value...)
+	for _, c := range children {
+		b = append(pad4(b), c...)
+	}
+	binary.LittleEndian.PutUint16(b[0:], uint16(len(b)))
+	return b
+}
+
+// windowsVersionInfo returns the RT_VERSION resource for cfg
+func windowsVersionInfo(cfg WindowsConfig, binFileName string) ([]byte, error) {
+	v, err := parseWindowsVersion(cfg.Version)
+	if err != nil {
+		return nil, err
+	}
+	ms, ls := uint32(v[0])<<16|uint32(v[1]), uint32(v[2])<<16|uint32(v[3])
+
+	// VS_FIXEDFILEINFO
+	var fixed []byte
+	for _, dw := range []uint32{
+		0xFEEF04BD, 0x00010000, // signature, struct version
+		ms, ls, ms, ls, // file and product version
+		0x3F, 0, // flags mask, flags
+		0x40004, 1, 0, // VOS_NT_WINDOWS32, VFT_APP, no subtype
+		0, 0, // date
+	} {
+		fixed = binary.LittleEndian.AppendUint32(fixed, dw)
+	}
+
+	version := fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+	var strs [][]byte
+	for _, kv := range [][2]string{
+		{"CompanyName", cfg.CompanyName},
+		{"FileDescription", cfg.ProductName},
+		{"FileVersion", version},
+		{"OriginalFilename", binFileName},
+		{"ProductName", cfg.ProductName},
+		{"ProductVersion", version},
+	} {
+		if kv[1] != "" {
+			value := utf16z(kv[1])
+			strs = append(strs, versionInfoBlock(kv[0], 1, value, uint16(len(value)/2)))
+		}
+	}
+
+	// US English, Unicode
+	stringFileInfo := versionInfoBlock("StringFileInfo", 1, nil, 0, versionInfoBlock("040904B0", 1, nil, 0, strs...))
+	varFileInfo := versionInfoBlock("VarFileInfo", 1, nil, 0, versionInfoBlock("Translation", 0, []byte{0x09, 0x04, 0xB0, 0x04}, 4))
+	return versionInfoBlock("VS_VERSION_INFO", 0, fixed, uint16(len(fixed)), stringFileInfo, varFileInfo), nil
+}
+
+// windowsIconResources returns the RT_ICON resources of all images in the
+// .ico file at path plus the RT_GROUP_ICON listing them
+func windowsIconResources(path string) ([]windowsResource, error) {
+	ico, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if len(ico) < 6 || le.Uint16(ico[0:]) != 0 || le.Uint16(ico[2:]) != 1 {
+		return nil, fmt.Errorf("%s is not an .ico file", path)
+	}
+	count := int(le.Uint16(ico[4:]))
+	if len(ico) < 6+16*count {
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+
+	var resources []windowsResource
+	group := binary.LittleEndian.AppendUint16(nil, 0)
+	group = le.AppendUint16(group, 1)
+	group = le.AppendUint16(group, uint16(count))
+	for i := 0; i < count; i++ {
+		entry := ico[6+16*i : 6+16*(i+1)]
+		size, offset := le.Uint32(entry[8:]), le.Uint32(entry[12:])
+		if uint64(offset)+uint64(size) > uint64(len(ico)) {
+			return nil, fmt.Errorf("%s: image %d is out of bounds", path, i)
+		}
+		id := uint16(i + 1)
+		resources = append(resources, windowsResource{Type: rtIcon, ID: id, Data: ico[offset : offset+size]})
+
+		// GRPICONDIRENTRY is the ICONDIRENTRY with the resource ID instead of the offset
+		group = append(group, entry[:12]...)
+		group = le.AppendUint16(group, id)
+	}
+	return append(resources, windowsResource{Type: rtGroupIcon, ID: 1, Data: group}), nil
+}
+
+// windowsResourceSection lays out resources as the directory tree of a
+// resource section (type, ID, language), returning the section plus the
+// offsets of the data RVAs that need relocating
+func windowsResourceSection(resources []windowsResource) ([]byte, []uint32) {
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Type != resources[j].Type {
+			return resources[i].Type < resources[j].Type
+		}
+		return resources[i].ID < resources[j].ID
+	})
+	var types []uint16
+	idsOf := map[uint16][]int{}
+	for i, r := range resources {
+		if len(idsOf[r.Type]) == 0 {
+			types = append(types, r.Type)
+		}
+		idsOf[r.Type] = append(idsOf[r.Type], i)
+	}
+
+	// first where everything goes
+	off := uint32(16 + 8*len(types))
+	typeDirOff := map[uint16]uint32{}
+	for _, t := range types {
+		typeDirOff[t] = off
+		off += uint32(16 + 8*len(idsOf[t]))
+	}
+	langDirOff := make([]uint32, len(resources))
+	for i := range resources {
+		langDirOff[i] = off
+		off += 16 + 8
+	}
+	dataEntryOff := make([]uint32, len(resources))
+	for i := range resources {
+		dataEntryOff[i] = off
+		off += 16
+	}
+	dataOff := make([]uint32, len(resources))
+	for i, r := range resources {
+		off = (off + 7) &^ 7
+		dataOff[i] = off
+		off += uint32(len(r.Data))
+	}
+
+	le := binary.LittleEndian
+	section := make([]byte, off)
+	dir := func(at uint32, entries int) {
+		le.PutUint16(section[at+14:], uint16(entries)) // all entries are IDs
+	}
+	dirEntry := func(at uint32, i int, id, target uint32) {
+		le.PutUint32(section[at+16+8*uint32(i):], id)
+		le.PutUint32(section[at+16+8*uint32(i)+4:], target)
+	}
+
+	dir(0, len(types))
+	for i, t := range types {
+		dirEntry(0, i, uint32(t), typeDirOff[t]|0x80000000)
+		dir(typeDirOff[t], len(idsOf[t]))
+		for j, ri := range idsOf[t] {
+			dirEntry(typeDirOff[t], j, uint32(resources[ri].ID), langDirOff[ri]|0x80000000)
+		}
+	}
+	var relocs []uint32
+	for i, r := range resources {
+		dir(langDirOff[i], 1)
+		dirEntry(langDirOff[i], 0, 0x0409, dataEntryOff[i])
+		le.PutUint32(section[dataEntryOff[i]:], dataOff[i])
+		le.PutUint32(section[dataEntryOff[i]+4:], uint32(len(r.Data)))
+		relocs = append(relocs, dataEntryOff[i])
+		copy(section[dataOff[i]:], r.Data)
+	}
+	return section, relocs
+}
+
+// coffObject wraps section as the .rsrc section of a COFF object, relocs are
+// the offsets of RVAs in it relative to the start of the section
+func coffObject(machine, relocType uint16, section []byte, relocs []uint32) []byte {
+	const headersSize = 20 + 40
+	relocsOff := uint32(headersSize + len(section))
+	symbolsOff := relocsOff + uint32(10*len(relocs))
+
+	le := binary.LittleEndian
+	var b []byte
+	// file header
+	b = le.AppendUint16(b, machine)
+	b = le.AppendUint16(b, 1) // sections
+	b = le.AppendUint32(b, 0) // timestamp, zero for reproducible output
+	b = le.AppendUint32(b, symbolsOff)
+	b = le.AppendUint32(b, 1) // symbols
+	b = le.AppendUint16(b, 0) // optional header size
+	b = le.AppendUint16(b, 0) // characteristics
+	// section header
+	b = append(b, ".rsrc\x00\x00\x00"...)
+	b = le.AppendUint32(b, 0) // virtual size
+	b = le.AppendUint32(b, 0) // virtual address
+	b = le.AppendUint32(b, uint32(len(section)))
+	b = le.AppendUint32(b, headersSize)
+	b = le.AppendUint32(b, relocsOff)
+	b = le.AppendUint32(b, 0) // line numbers
+	b = le.AppendUint16(b, uint16(len(relocs)))
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint32(b, 0x40000040) // initialized data, readable
+
+	b = append(b, section...)
+	for _, r := range relocs {
+		b = le.AppendUint32(b, r)
+		b = le.AppendUint32(b, 0) // the .rsrc section symbol
+		b = le.AppendUint16(b, relocType)
+	}
+	// symbol table: the section symbol the relocations refer to
+	b = append(b, ".rsrc\x00\x00\x00"...)
+	b = le.AppendUint32(b, 0) // value
+	b = le.AppendUint16(b, 1) // section number
+	b = le.AppendUint16(b, 0) // type
+	b = append(b, 3, 0)       // IMAGE_SYM_CLASS_STATIC, no aux symbols
+	// empty string table
+	return le.AppendUint32(b, 4)
+}
+
 func init() {
 	scriptExt := "sh"
 	if runtime.GOOS == "windows" {
@@ -186,61 +1040,229 @@ func findDirUpwardsContaining(filename string) (string, error) {
 	return "", fmt.Errorf("file %s not found in any parent directory", filename)
 }
 
+// readModulePath returns the module path from the closest go.mod upwards
+// plus the directory containing it
+func readModulePath() (string, string, bool) {
+	goModDir, err := findDirUpwardsContaining("go.mod")
+	if err != nil {
+		return "", "", false
+	}
+
+	goModPath := filepath.Join(goModDir, "go.mod")
+	goModContents, err := os.ReadFile(goModPath)
+	if err != nil {
+		return "", "", false
+	}
+	debugf("Reading module path from: %s\n", goModPath)
+	for _, line := range bytes.Split(goModContents, []byte{'\n'}) {
+		if bytes.HasPrefix(line, []byte("module ")) {
+			fields := bytes.Fields(line)
+			if len(fields) >= 2 {
+				return string(fields[1]), goModDir, true
+			}
+		}
+	}
+	return "", "", false
+}
+
 func determineBinName() {
 	if config.BinName != "" {
 		// can be overriden in build.json
 		return
 	}
 
-	readSuccessfullyFromGoMod := func() bool {
-		// Try to read project name from ../go.mod
-		goModPath, err := findDirUpwardsContaining("go.mod")
+	if modulePath, _, ok := readModulePath(); ok {
+		config.BinName = filepath.Base(modulePath)
+		debugf("New config BinName: %s\n", config.BinName)
+	} else {
+		config.BinName = "bin"
+	}
+}
+
+var versionVarRegex = regexp.MustCompile(`^[A-Za-z0-9._~/-]+\.[A-Za-z_][A-Za-z0-9_]*$`)
+
+// versionLdflags returns the -X flags for config.VersionVars, none with
+// -no-version. Values git can't provide (e.g. no repository) are "unknown".
+func versionLdflags() []string {
+	if flagNoVersion {
+		return nil
+	}
+	git := func(args ...string) (string, error) {
+		out, err := exec.Command("git", args...).Output()
 		if err != nil {
-			return false
+			return "", fmt.Errorf("git %s: %w", args[0], err)
 		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	describe := func() (string, error) { return git("describe", "--tags", "--always", "--dirty") }
+	date := func() (string, error) {
+		date, err := buildDate(git)
+		return date.UTC().Format(time.RFC3339), err
+	}
 
-		goModPath = filepath.Join(goModPath, "go.mod")
+	var ldflags []string
+	for _, v := range sortedKeys(config.VersionVars) {
+		if !versionVarRegex.MatchString(v) {
+			fmt.Fprintf(os.Stderr, "Invalid versionVars entry %q: expected <import path>.<variable>\n", v)
+			os.Exit(2)
+		}
+		if !versionVarExists(v) {
+			fmt.Fprintf(os.Stderr, "Warning: versionVars: variable %s not found\n", v)
+		}
 
-		goModContents, err := os.ReadFile(goModPath)
-		if err == nil {
-			debugf("Reading project name from: %s\n", goModPath)
-			for _, line := range bytes.Split(goModContents, []byte{'\n'}) {
-				if bytes.HasPrefix(line, []byte("module ")) {
-					fields := bytes.Fields(line)
-					if len(fields) >= 2 {
-						modulePath := string(fields[1])
-						config.BinName = filepath.Base(modulePath)
-						debugf("New config BinName: %s\n", config.BinName)
-					}
-					return true
-				}
+		orUnknown := func(value string, err error) string {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: versionVars: using \"unknown\" for %s: %v\n", v, err)
+				return "unknown"
 			}
+			return value
+		}
+
+		var value string
+		switch kind := config.VersionVars[v]; kind {
+		case "version":
+			value = orUnknown(describe())
+		case "commit":
+			value = orUnknown(git("rev-parse", "HEAD"))
+		case "date":
+			value = orUnknown(date())
+		case "stamp":
+			value = orUnknown(describe()) + " " + orUnknown(date())
+		default:
+			fmt.Fprintf(os.Stderr, "Invalid versionVars value %q for %s: expected version, commit, date or stamp\n", kind, v)
+			os.Exit(2)
+		}
+		if strings.Contains(value, " ") {
+			ldflags = append(ldflags, fmt.Sprintf("-X '%s=%s'", v, value)) // quoted for 'go build -ldflags'
+		} else {
+			ldflags = append(ldflags, fmt.Sprintf("-X %s=%s", v, value))
 		}
-		return false
 	}
+	return ldflags
+}
 
-	if !readSuccessfullyFromGoMod() {
-		config.BinName = "bin"
+// buildDate is now, or with -reproducible $SOURCE_DATE_EPOCH, falling back
+// to the time of the current commit
+func buildDate(git func(args ...string) (string, error)) (time.Time, error) {
+	if !flagReproducible {
+		return time.Now(), nil
 	}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		var err error
+		if epoch, err = git("log", "-1", "--format=%ct"); err != nil {
+			return time.Time{}, err
+		}
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// versionVarExists is a best effort check that the package of an
+// "<import path>.<variable>" inside of this module mentions the variable.
+// Packages of other modules are assumed to be fine.
+func versionVarExists(v string) bool {
+	i := strings.LastIndex(v, ".")
+	pkg, name := v[:i], v[i+1:]
+
+	modulePath, goModDir, ok := readModulePath()
+	if !ok {
+		return true
+	}
+	var dir string
+	switch {
+	case pkg == "main":
+		dir = "."
+	case pkg == modulePath:
+		dir = goModDir
+	case strings.HasPrefix(pkg, modulePath+"/"):
+		dir = filepath.Join(goModDir, filepath.FromSlash(strings.TrimPrefix(pkg, modulePath+"/")))
+	default:
+		return true
+	}
+
+	decl := regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b[^\n]*(=|\bstring\b)`)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, f := range files {
+		if contents, err := os.ReadFile(f); err == nil && decl.Match(contents) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ghEscape escapes the message of a GitHub Actions workflow command,
+// ghEscapeProperty the value of one of its properties
+func ghEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func ghEscapeProperty(s string) string {
+	return strings.NewReplacer(":", "%3A", ",", "%2C").Replace(ghEscape(s))
+}
+
+// truncateOutput cuts s down to its last max bytes, where errors usually are
+func truncateOutput(s string, max int) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= max {
+		return s
+	}
+	return "..." + s[len(s)-max:]
 }
 
 func parseCLIFlags() {
+	flag.BoolVar(&flagAdaptive, "adaptive", false, "Start with one build worker per CPU, but run fewer while the system load is high")
+	flag.BoolVar(&flagAtomic, "atomic", false, "Build into a temporary directory and only move the binaries into ./bin once all targets built, leaving the previous ones intact on failure")
 	flag.BoolVar(&flagBuildAll, "a", false, "Build all defined GOOS/GOARCH targets")
 	flag.BoolVar(&flagBuildAll, "all", false, "Build all defined GOOS/GOARCH targets (same as -a)")
+	flag.BoolVar(&flagCheckOnly, "c", false, "Only check that the targets compile (all of them with -a), discard binaries (implies -nos)")
+	flag.BoolVar(&flagCheckOnly, "check-only", false, "Only check that the targets compile (all of them with -a), discard binaries (same as -c)")
 	flag.BoolVar(&flagDebug, "d", false, "Enable debug mode")
 	flag.BoolVar(&flagDebug, "debug", false, "Enable debug mode (same as -d)")
+	flag.BoolVar(&flagGHAnnotate, "github-annotations", flagGHAnnotate, "Also report build failures as GitHub Actions '::error::' annotations (default: $GITHUB_ACTIONS == true)")
+	flag.StringVar(&flagGoflags, "goflags", "", "Added to $GOFLAGS of 'go get' and 'go build', after the 'goflags' config, e.g. -mod=vendor")
 	flag.BoolVar(&flagNoGoGet, "nogg", false, "Don't run 'go get' before building")
 	flag.BoolVar(&flagNoGoGet, "no-go-get", false, "Don't run 'go get' before building (same as -nogg)")
 	flag.BoolVar(&flagNoSymlink, "nos", false, "Don't generate a symlink for the current target")
 	flag.BoolVar(&flagNoSymlink, "no-symlink", false, "Don't generate a symlink for the current target (same as -nos)")
+	flag.BoolVar(&flagNoVersion, "no-version", false, "Don't inject the 'versionVars' of the config")
+	flag.BoolVar(&flagPrintConfig, "print-config", false, "Print the effective config and the targets it selects, with their env and ldflags, as JSON and exit without building")
+	flag.StringVar(&flagProfile, "p", "", "Build the platforms of this 'profiles' entry of the config (instead of the current one or -all)")
+	flag.StringVar(&flagProfile, "profile", "", "Build the platforms of this 'profiles' entry of the config (same as -p)")
+	flag.BoolVar(&flagReport, "r", false, "Print a table of all built binaries with their size and sha256")
+	flag.BoolVar(&flagReport, "report", false, "Print a table of all built binaries with their size and sha256 (same as -r)")
+	flag.BoolVar(&flagReproducible, "reproducible", false, "Build byte-identical binaries: -trimpath, -buildvcs=false, empty build ID, 'date' versionVars from $SOURCE_DATE_EPOCH or the commit time")
+	flag.BoolVar(&flagRun, "run", false, "Run the current platform's binary after building, passing on all arguments after '--'")
+	flag.BoolVar(&flagUpload, "upload", false, "Upload all built binaries as configured in 'upload' after a successful build")
+	flag.BoolVar(&flagSplitDebug, "split-debug", false, "Strip binaries and build an unstripped '<binary>.debug' next to each")
+	flag.StringVar(&flagSuffix, "ns", "", "Suffix appended to the bin name of all outputs, e.g. '-debug' for '<binName>-debug_linux_amd64'")
+	flag.StringVar(&flagSuffix, "name-suffix", "", "Suffix appended to the bin name of all outputs (same as -ns)")
 
 	flag.Usage = func() {
 		fmt.Printf("To build a target for your current platform,\nrun this program without arguments.\n\n")
+		fmt.Printf("To build and then run it: -run -- <args...>\n\n")
 		flag.PrintDefaults()
 	}
 
 	// Parse flags
 	flag.Parse()
+
+	if !regexp.MustCompile(`^[A-Za-z0-9._-]*$`).MatchString(flagSuffix) {
+		fmt.Fprintf(os.Stderr, "Invalid -name-suffix %q: only letters, digits, '.', '_' and '-' are allowed\n", flagSuffix)
+		os.Exit(2)
+	}
 }
 
 func main() {
@@ -277,38 +1299,120 @@ func main() {
 
 		determineBinName()
 
+		if flagUpload {
+			if config.Upload == nil || config.Upload.URL == "" {
+				fmt.Fprintf(os.Stderr, "-upload requires an 'upload' section with a 'url' in %s\n", CONFIG_FILE_NAME)
+				os.Exit(2)
+			}
+			if m := config.Upload.Method; m != "put" && m != "s3" {
+				fmt.Fprintf(os.Stderr, "Invalid upload method %q: expected put or s3\n", m)
+				os.Exit(2)
+			}
+		}
+
+		for name, entries := range config.Profiles {
+			for _, e := range entries {
+				if !slices.ContainsFunc(expandPlatforms(config.Platforms), func(p Platform) bool { return p.inProfile([]string{e}) }) {
+					fmt.Fprintf(os.Stderr, "Profile %q: %q is not one of the platforms\n", name, e)
+					os.Exit(2)
+				}
+			}
+		}
+		if _, ok := config.Profiles[flagProfile]; flagProfile != "" && !ok {
+			fmt.Fprintf(os.Stderr, "Unknown profile %q, see 'profiles' in %s\n", flagProfile, CONFIG_FILE_NAME)
+			os.Exit(2)
+		}
+
+		if config.SymlinkName == "" {
+			config.SymlinkName = config.BinName
+		}
+		if strings.ContainsAny(config.SymlinkName, `/\`) {
+			fmt.Fprintf(os.Stderr, "Invalid symlinkName %q: must not contain path separators\n", config.SymlinkName)
+			os.Exit(2)
+		}
+
+		if config.Windows != nil {
+			if _, err := parseWindowsVersion(config.Windows.Version); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid windows section: %v\n", err)
+				os.Exit(2)
+			}
+		}
+
 		debugf("Config: %+v\n", config)
 	}
 
+	versionFlags := versionLdflags()
+
 	// RunEntry describes a single process to launch
 	type RunEntry struct {
+		Name string // GOOS/GOARCH this entry builds
+		Out  string // path of the built binary
+		Tmp  string // where 'go build' writes Out to with -atomic
 		Args []string
 		Env  map[string]string
+
+		Weight int // see Platform.Weight
 	}
 
 	var entries []RunEntry
 
+	// GOFLAGS of config.Env, then config.Goflags, then -goflags
+	var goflags []string
+	for _, f := range []string{config.Env["GOFLAGS"], config.Goflags, flagGoflags} {
+		if f != "" {
+			goflags = append(goflags, f)
+		}
+	}
+	goEnv := map[string]string{}
+	if len(goflags) > 0 {
+		goEnv["GOFLAGS"] = strings.Join(goflags, " ")
+	}
+
 	// 'run go get' first
-	if !flagNoGoGet {
-		run([]string{"go", "get"}, nil)
+	if !flagNoGoGet && !flagPrintConfig {
+		run([]string{"go", "get"}, goEnv)
+	}
+
+	// with -atomic everything is built into atomicDir first, on the same
+	// file system to be able to rename the binaries into place
+	atomicDir := ""
+	if flagAtomic && !flagCheckOnly && !flagPrintConfig {
+		check(os.MkdirAll("bin", 0o755))
+		var err error
+		atomicDir, err = os.MkdirTemp("bin", ".atomic-")
+		check(err)
 	}
 
 	{ // add all GOOS/GOARCH combinations from the config
-		for _, triplet := range config.Platforms {
-			goos := strings.ToLower(triplet[0])
-			goarch := strings.ToLower(triplet[1])
+		for _, platform := range expandPlatforms(config.Platforms) {
+			goos := strings.ToLower(platform.GOOS)
+			goarch := strings.ToLower(platform.GOARCH)
+
+			// what tells builds of goarch apart, e.g. "armv7"
+			arch := goarch
+			if len(platform.GOARM) == 1 {
+				arch += "v" + platform.GOARM[0]
+			}
 
 			isCurrentPlatform := ((goos == runtime.GOOS) && (goarch == runtime.GOARCH))
 
-			if flagBuildAll || isCurrentPlatform {
+			selected := flagBuildAll || isCurrentPlatform
+			if flagProfile != "" {
+				selected = platform.inProfile(config.Profiles[flagProfile])
+			}
+			if selected {
 				binExtension := ""
 				if goos == "windows" {
 					binExtension = ".exe"
 				}
 
-				fileSuffix := fmt.Sprintf("%s_%s%s", goos, goarch, binExtension)
-				fileName := fmt.Sprintf("%s_%s", config.BinName, fileSuffix)
+				fileSuffix := fmt.Sprintf("%s_%s%s", goos, arch, binExtension)
+				fileName := fmt.Sprintf("%s%s_%s", config.BinName, flagSuffix, fileSuffix)
 				filePath := fmt.Sprintf("./bin/%s", fileName)
+				if flagCheckOnly {
+					// compile only, let the go toolchain discard the binary
+					filePath = os.DevNull
+				}
 
 				if isCurrentPlatform {
 					currentBinPath = filePath
@@ -323,29 +1427,86 @@ func main() {
 				for k, v := range config.Env {
 					env[k] = v
 				}
+				for k, v := range goEnv {
+					env[k] = v
+				}
+				if len(platform.GOARM) == 1 {
+					env["GOARM"] = platform.GOARM[0]
+				}
+
+				baseLdflags := append(append([]string(nil), versionFlags...), platform.ldflags()...)
+				ldflags := append([]string(nil), baseLdflags...)
+				splitDebug := (flagSplitDebug || config.SplitDebug) && !flagCheckOnly
+				if splitDebug {
+					// the release binary is stripped, the debug one below keeps everything
+					ldflags = append(ldflags, "-s", "-w")
+				}
+
+				buildPath := filePath
+				if atomicDir != "" {
+					buildPath = filepath.Join(atomicDir, fileName)
+				}
 
 				// append
 				entries = append(entries, RunEntry{
-					Args: []string{
-						"go",
-						"build",
-						"-o",
-						filePath,
-					},
-					Env: env,
+					Name:   fmt.Sprintf("%s/%s", goos, arch),
+					Out:    filePath,
+					Tmp:    buildPath,
+					Args:   goBuildArgs(buildPath, ldflags),
+					Env:    env,
+					Weight: platform.Weight,
 				})
+				if splitDebug {
+					entries = append(entries, RunEntry{
+						Name:   fmt.Sprintf("%s/%s (debug)", goos, arch),
+						Out:    filePath + ".debug",
+						Tmp:    buildPath + ".debug",
+						Args:   goBuildArgs(buildPath+".debug", baseLdflags),
+						Env:    env,
+						Weight: platform.Weight,
+					})
+				}
 			}
 
 		}
 	}
 
-	// symlink current GOOS/GOARCH
-	if !flagNoSymlink {
+	if flagPrintConfig {
+		type target struct {
+			Name    string            `json:"name"`
+			Out     string            `json:"out"`
+			Env     map[string]string `json:"env"`
+			Ldflags string            `json:"ldflags"`
+			Command []string          `json:"command"`
+		}
+		outputDir, err := filepath.Abs("bin")
+		check(err)
+		effective := struct {
+			ConfigPath string      `json:"configPath"`
+			OutputDir  string      `json:"outputDir"`
+			Config     BuildConfig `json:"config"`
+			Targets    []target    `json:"targets"`
+		}{ConfigPath: configPath, OutputDir: outputDir, Config: config, Targets: []target{}}
+		for _, entry := range entries {
+			t := target{Name: entry.Name, Out: entry.Out, Env: entry.Env, Command: entry.Args}
+			if i := slices.Index(entry.Args, "-ldflags"); i >= 0 && i+1 < len(entry.Args) {
+				t.Ldflags = entry.Args[i+1]
+			}
+			effective.Targets = append(effective.Targets, t)
+		}
+		out, err := json.MarshalIndent(effective, "", "  ")
+		check(err)
+		fmt.Printf("%s\n", out)
+		return
+	}
+
+	// symlink current GOOS/GOARCH, unless -profile doesn't build it
+	if !flagNoSymlink && !flagCheckOnly && currentBinPath != "" {
 		var currentSymlinkPath = ""
 		if runtime.GOOS == "windows" {
-			currentSymlinkPath = fmt.Sprintf("%s.exe", config.BinName)
+			currentSymlinkPath = fmt.Sprintf("%s%s.exe", config.SymlinkName, flagSuffix)
 		} else {
-			currentSymlinkPath = fmt.Sprintf("%s", config.BinName)
+			currentSymlinkPath = fmt.Sprintf("%s%s", config.SymlinkName, flagSuffix)
 		}
 
 		err := ensureSymlink(currentSymlinkPath, currentBinPath)
@@ -410,38 +1571,61 @@ func main() {
 			}
 		}
 
+		// windows version info resources, picked up by 'go build' via their
+		// _windows_<goarch> suffix and removed again once all builds are done
+		var sysoPaths []string
+		if config.Windows != nil {
+			for _, entry := range entries {
+				goarch := entry.Env["GOARCH"]
+				sysoPath := fmt.Sprintf("buildtool_rsrc_windows_%s.syso", goarch)
+				if entry.Env["GOOS"] != "windows" || slices.Contains(sysoPaths, sysoPath) {
+					continue
+				}
+				if err := writeWindowsSyso(sysoPath, goarch, filepath.Base(entry.Out), *config.Windows); err != nil {
+					for _, p := range sysoPaths {
+						os.Remove(p)
+					}
+					if atomicDir != "" {
+						os.RemoveAll(atomicDir)
+					}
+					fmt.Fprintf(os.Stderr, "Generating windows resources: %v\n", err)
+					os.Exit(1)
+				}
+				sysoPaths = append(sysoPaths, sysoPath)
+			}
+		}
+
 		{
 			var (
 				numWorkers = runtime.NumCPU()
-				jobs       = make(chan RunEntry)
+				sem        = newWeightedSemaphore(numWorkers)
 				results    = make(chan Result, len(entries))
 			)
 
-			{ // Run all Entries in parallel
+			{ // Run all Entries in parallel, as long as their summed weight fits into numWorkers
 				var wg sync.WaitGroup
 
-				// Start workers
-				for i := 0; i < numWorkers; i++ {
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-						for entry := range jobs {
-							results <- runEntry(entry)
-						}
-					}()
+				adaptDone := make(chan struct{})
+				if flagAdaptive {
+					go adaptLimit(sem, adaptDone)
 				}
 
-				// Send jobs
 				go func() {
 					for _, entry := range entries {
-						jobs <- entry
+						weight := sem.Acquire(entry.Weight)
+						debugf("Scheduling %s (weight %d, %d/%d workers in use)\n", entry.Name, weight, sem.Used(), sem.Limit())
+
+						wg.Add(1)
+						go func(entry RunEntry) {
+							defer wg.Done()
+							defer sem.Release(weight)
+							results <- runEntry(entry)
+						}(entry)
 					}
-					close(jobs)
-				}()
 
-				// Wait for all workers to finish
-				go func() {
+					// Wait for all entries to finish
 					wg.Wait()
+					close(adaptDone)
 					close(results)
 				}()
 			}
@@ -452,16 +1636,25 @@ func main() {
 					for result := range results {
 						sortedResults = append(sortedResults, result)
 					}
+					for _, p := range sysoPaths {
+						os.Remove(p)
+					}
 
 					sort.Slice(sortedResults, func(i, j int) bool {
-						return fmt.Sprintf("%v", sortedResults[i].Entry.Args) < fmt.Sprintf("%v", sortedResults[j].Entry.Args)
+						argsI := fmt.Sprintf("%v", sortedResults[i].Entry.Args)
+						argsJ := fmt.Sprintf("%v", sortedResults[j].Entry.Args)
+						if argsI == argsJ {
+							// e.g. -check-only, where every entry writes to os.DevNull
+							return sortedResults[i].Entry.Name < sortedResults[j].Entry.Name
+						}
+						return argsI < argsJ
 					})
 				}
 
 				var failures []Result
 				for _, result := range sortedResults {
 					if flagDebug {
-						debugf("---\nCommand: %v\nEnv: %v\n", result.Entry.Args, result.Entry.Env)
+						debugf("---\nTarget: %s\nCommand: %v\nEnv: %v\n", result.Entry.Name, result.Entry.Args, result.Entry.Env)
 						if result.ExitCode != 0 {
 							debugf("Exit Code: %d\n", result.ExitCode)
 						}
@@ -477,15 +1670,85 @@ func main() {
 					}
 				}
 
+				if flagCheckOnly {
+					for _, result := range sortedResults {
+						if result.Err == nil && result.ExitCode == 0 {
+							fmt.Printf("ok  %s\n", result.Entry.Name)
+						}
+					}
+				}
+
 				if len(failures) > 0 {
 					fmt.Fprintf(os.Stderr, "XXX : Failures:\n")
 					for _, fail := range failures {
-						fmt.Fprintf(os.Stderr, "Command: %v\nExit code: %d\nStdout: %sStderr: %sError: %v\n---\n",
-							fail.Entry.Args, fail.ExitCode, fail.Stdout, fail.Stderr, fail.Err)
+						fmt.Fprintf(os.Stderr, "Target: %s\nCommand: %v\nExit code: %d\nStdout: %sStderr: %sError: %v\n---\n",
+							fail.Entry.Name, fail.Entry.Args, fail.ExitCode, fail.Stdout, fail.Stderr, fail.Err)
+					}
+					if flagGHAnnotate {
+						for _, fail := range failures {
+							msg := fail.Stderr
+							if msg == "" && fail.Err != nil {
+								msg = fail.Err.Error()
+							}
+							fmt.Printf("::error title=Build failed for %s::%s\n", ghEscapeProperty(fail.Entry.Name), ghEscape(truncateOutput(msg, 4000)))
+						}
+					}
+					if atomicDir != "" {
+						os.RemoveAll(atomicDir)
+					} else {
+						// some binaries may have been replaced already
+						os.Remove(sha256SumsPath)
 					}
 					os.Exit(1)
 				}
 
+				if atomicDir != "" {
+					for _, result := range sortedResults {
+						check(os.Rename(result.Entry.Tmp, result.Entry.Out))
+					}
+					os.RemoveAll(atomicDir)
+				}
+
+				if !flagCheckOnly && len(sortedResults) > 0 {
+					var outs []string
+					for _, result := range sortedResults {
+						outs = append(outs, result.Entry.Out)
+					}
+					check(writeSha256Sums(outs))
+					debugf("Wrote %s\n", sha256SumsPath)
+				}
+
+				if flagSplitDebug || config.SplitDebug {
+					for _, result := range sortedResults {
+						fmt.Printf("Built %s\n", result.Entry.Out)
+					}
+				}
+
+				if flagReport && !flagCheckOnly {
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintf(w, "PLATFORM\tFILE\tSIZE\tSHA256\n")
+					for _, result := range sortedResults {
+						size, sum, err := fileSizeAndSha256(result.Entry.Out)
+						check(err)
+						fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", result.Entry.Name, filepath.Base(result.Entry.Out), size, sum[:12])
+					}
+					w.Flush()
+				}
+
+				if flagUpload && !flagCheckOnly {
+					var uploadFailed bool
+					for _, result := range sortedResults {
+						entry := result.Entry
+						if err := uploadArtifact(entry.Out, entry.Env); err != nil {
+							fmt.Fprintf(os.Stderr, "Uploading %s failed: %v\n", entry.Out, err)
+							uploadFailed = true
+						}
+					}
+					if uploadFailed {
+						os.Exit(1)
+					}
+				}
+
 				if !flagBuildAll {
 					debugf("\nAll builds succeeded. (Only Current GOOS/GOARCH, pass -all to build all targets)\n")
 				} else {
@@ -496,8 +1759,35 @@ func main() {
 
 		{ // optionally run 'build-hook-post' if existing
 			if isExecutable(buildHookPostPath) {
-				run([]string{buildHookPostPath}, nil)
+				binDir, err := filepath.Abs("bin")
+				check(err)
+				hookEnv := map[string]string{
+					"BUILD_TOOL_BIN_DIR":     binDir,
+					"BUILD_TOOL_BIN_NAME":    config.BinName + flagSuffix,
+					"BUILD_TOOL_CURRENT_BIN": "",
+				}
+				if currentBinPath != "" && !flagCheckOnly {
+					hookEnv["BUILD_TOOL_CURRENT_BIN"], err = filepath.Abs(currentBinPath)
+					check(err)
+				}
+				run([]string{buildHookPostPath}, hookEnv)
 			}
 		}
 	}
+	if flagRun && (currentBinPath == "" || flagCheckOnly) {
+		fmt.Printf("Skipping -run: no binary was built for the current platform (%s/%s)\n", runtime.GOOS, runtime.GOARCH)
+	} else if flagRun {
+		cmd := exec.Command(currentBinPath, flag.Args()...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		debugf("Running '%s %s'...\n", currentBinPath, flag.Args())
+
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		check(err)
+	}
 }
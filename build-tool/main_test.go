@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSha256Sums(t *testing.T) {
+	t.Chdir(t.TempDir())
+	check(os.Mkdir("bin", 0o755))
+
+	binaries := map[string]string{
+		"demo_linux_amd64":       "linux binary",
+		"demo_windows_amd64.exe": "windows binary",
+		"demo_darwin_arm64":      "darwin binary",
+	}
+	var paths []string
+	for name, content := range binaries {
+		path := filepath.Join("bin", name)
+		check(os.WriteFile(path, []byte(content), 0o755))
+		paths = append(paths, path)
+	}
+	// not built by this run, so not listed
+	check(os.WriteFile(filepath.Join("bin", "demo_linux_amd64.debug"), []byte("debug info"), 0o644))
+	check(os.WriteFile(filepath.Join("bin", "old_linux_386"), []byte("stale binary"), 0o755))
+
+	if err := writeSha256Sums(paths); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(sha256SumsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for _, name := range []string{"demo_darwin_arm64", "demo_linux_amd64", "demo_windows_amd64.exe"} {
+		sum := sha256.Sum256([]byte(binaries[name]))
+		want.WriteString(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+	}
+	if string(data) != want.String() {
+		t.Errorf("%s is\n%s\nwant\n%s", sha256SumsPath, data, want.String())
+	}
+
+	// the format 'sha256sum -c' reads, run from within bin
+	line := regexp.MustCompile(`^[0-9a-f]{64}  [^/\s]+$`)
+	for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if !line.MatchString(l) {
+			t.Errorf("malformed line %q", l)
+		}
+	}
+
+	if _, err := os.Stat(sha256SumsPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+// TestReproducibleBuild builds the same program from two different
+// directories with -reproducible and expects byte-identical binaries
+func TestReproducibleBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a binary twice")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not found")
+	}
+
+	old := flagReproducible
+	flagReproducible = true
+	defer func() { flagReproducible = old }()
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	t.Setenv("GOWORK", "off")
+	t.Setenv("GOFLAGS", "")
+
+	date, err := buildDate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1700000000, 0); !date.Equal(want) {
+		t.Fatalf("buildDate() = %v, want %v", date, want)
+	}
+	ldflags := []string{"-X main.date=" + date.UTC().Format(time.RFC3339)}
+
+	build := func() string {
+		dir := t.TempDir()
+		check(os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module demo\n\ngo 1.21\n"), 0o644))
+		check(os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nvar date string\n\nfunc main() { println(date) }\n"), 0o644))
+
+		out := filepath.Join(dir, "demo")
+		args := goBuildArgs(out, ldflags)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", strings.Join(args, " "), err, output)
+		}
+		_, sum, err := fileSizeAndSha256(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+
+	if first, second := build(), build(); first != second {
+		t.Errorf("-reproducible builds differ: sha256 %s vs %s", first, second)
+	}
+}
+
+func TestS3CanonicalQuery(t *testing.T) {
+	for rawQuery, want := range map[string]string{
+		"":                         "",
+		"uploads":                  "uploads=",
+		"b=2&a=1":                  "a=1&b=2",
+		"a-b=1&a=2":                "a=2&a-b=1",
+		"x=2&x=1":                  "x=1&x=2",
+		"prefix=a b/c&marker=%7E*": "marker=~%2A&prefix=a%20b%2Fc",
+	} {
+		got, err := s3CanonicalQuery(rawQuery)
+		if err != nil {
+			t.Errorf("s3CanonicalQuery(%q): %v", rawQuery, err)
+		} else if got != want {
+			t.Errorf("s3CanonicalQuery(%q) = %q, want %q", rawQuery, got, want)
+		}
+	}
+}
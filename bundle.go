@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A bundle is a .tar.gz holding a manifest.json plus the fetched body of
+// every .upd file below the project root under content/<basefile>, so
+// vendored state can be moved across network boundaries without re-fetching.
+const (
+	bundleManifestName = "manifest.json"
+	bundleContentDir   = "content"
+)
+
+// BundleManifest is the manifest.json of a bundle
+type BundleManifest struct {
+	UpdVersion int           `json:"upd.version"`
+	Entries    []BundleEntry `json:"entries"`
+}
+
+// BundleEntry describes a single .upd file in a bundle, paths are
+// slash-separated and relative to the project root
+type BundleEntry struct {
+	Upd      string `json:"upd"`
+	Basefile string `json:"basefile"`
+	URL      string `json:"url"`
+	Sha256   string `json:"sha256"`
+
+	UnixSocket string `json:"unixSocket,omitempty"`
+}
+
+// exportBundle fetches (or takes from the cache) the content of every .upd
+// file below projectRoot and writes it together with its metadata to bundlePath
+func exportBundle(projectRoot, bundlePath string) error {
+	updPaths, err := findUpdFiles(projectRoot)
+	if err != nil {
+		return fmt.Errorf("walking %s: %w", projectRoot, err)
+	}
+
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(cacheDir, 0o755)
+
+	manifest := BundleManifest{UpdVersion: 1}
+	contents := map[string][]byte{}
+	for _, updPath := range updPaths {
+		upd, err := loadUpdFile(updPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", updPath, err)
+		}
+		basefile, err := basefileFor(updPath, upd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", updPath, err)
+		}
+		fr, err := fetchRequestFor(cacheDir, upd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", updPath, err)
+		}
+		fetched, err := fetchURL(fr)
+		if err != nil {
+			return fmt.Errorf("fetching %s: %w", upd.URL, err)
+		}
+		content, err := os.ReadFile(fetched.Path)
+		if err != nil {
+			return fmt.Errorf("reading cache: %w", err)
+		}
+
+		relUpd, err := filepath.Rel(projectRoot, updPath)
+		if err != nil {
+			return err
+		}
+		relBasefile, err := filepath.Rel(projectRoot, basefile)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(content)
+		entry := BundleEntry{
+			Upd:      filepath.ToSlash(relUpd),
+			Basefile: filepath.ToSlash(relBasefile),
+			URL:      upd.URL,
+			Sha256:   hex.EncodeToString(hash[:]),
+
+			UnixSocket: upd.UnixSocket,
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		contents[entry.Basefile] = content
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now()
+	writeMember := func(name string, data []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	if err := writeMember(bundleManifestName, manifestData); err != nil {
+		return fmt.Errorf("writing %s: %w", bundlePath, err)
+	}
+	for _, entry := range manifest.Entries {
+		if err := writeMember(path.Join(bundleContentDir, entry.Basefile), contents[entry.Basefile]); err != nil {
+			return fmt.Errorf("writing %s: %w", bundlePath, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", bundlePath, err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", bundlePath, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("writing %s: %w", bundlePath, err)
+	}
+
+	fmt.Printf("Exported %d file(s) to %s\n", len(manifest.Entries), bundlePath)
+	return nil
+}
+
+// importBundle verifies every entry of the bundle at bundlePath against its
+// checksum, then seeds the cache and writes the basefiles the .upd files
+// below projectRoot resolve to from it the way updateFile would, so
+// 'extract', 'jsonPath', 'header', 'manualReview' and the like apply
+func importBundle(projectRoot, bundlePath string) error {
+	in, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", bundlePath, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var manifest *BundleManifest
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", bundlePath, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", bundlePath, err)
+		}
+		if hdr.Name == bundleManifestName {
+			manifest = &BundleManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return fmt.Errorf("parsing %s: %w", bundleManifestName, err)
+			}
+			continue
+		}
+		if rel, ok := strings.CutPrefix(hdr.Name, bundleContentDir+"/"); ok {
+			contents[rel] = data
+		}
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s has no %s", bundlePath, bundleManifestName)
+	}
+
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		return err
+	}
+
+	// verify everything before touching any file, the bundle holds the
+	// fetched bodies, which the .upd files turn into their basefiles just
+	// like an update does
+	type importedFile struct {
+		upd              UpdFile
+		basefile         string
+		content, written []byte
+	}
+	var imports []importedFile
+	for _, entry := range manifest.Entries {
+		content, ok := contents[entry.Basefile]
+		if !ok {
+			return fmt.Errorf("%s is missing from bundle", entry.Basefile)
+		}
+		hash := sha256.Sum256(content)
+		if actual := hex.EncodeToString(hash[:]); !strings.EqualFold(actual, entry.Sha256) {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", entry.Basefile, entry.Sha256, actual)
+		}
+
+		updPath := filepath.Join(projectRoot, filepath.FromSlash(entry.Upd))
+		upd, err := loadUpdFile(updPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", updPath, err)
+		}
+		if upd.URL != entry.URL || upd.UnixSocket != entry.UnixSocket {
+			return fmt.Errorf("%s: fetches %s now, but the bundle holds %s", updPath, upd.URL, entry.URL)
+		}
+		// where the .upd file writes to now, its 'target' may have changed
+		basefile, err := basefileFor(updPath, upd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", updPath, err)
+		}
+		if rel, err := filepath.Rel(projectRoot, basefile); err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("refusing to write %s outside of the project root", basefile)
+		}
+		if err := checkExtensionAllowed(basefile); err != nil {
+			return err
+		}
+		if len(content) == 0 && !upd.AllowEmpty {
+			return fmt.Errorf("%s: the bundle holds an empty body for %s (set 'allowEmpty: true' if that's expected)", updPath, entry.URL)
+		}
+		transformed, err := transformContent(upd, basefile, content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", updPath, err)
+		}
+		imports = append(imports, importedFile{upd, basefile, transformed, withHeader(upd, basefile, transformed)})
+	}
+
+	if !flagDryRun {
+		os.MkdirAll(cacheDir, 0o755)
+		for _, entry := range manifest.Entries {
+			// seed the cache, the stale validators of an older entry would
+			// make the next online run trust a body they don't describe
+			fr := FetchRequest{URL: entry.URL, UnixSocket: entry.UnixSocket}
+			cachePath := cachePathFor(cacheDir, fr.cacheKey())
+			if err := os.WriteFile(cachePath, contents[entry.Basefile], 0o644); err != nil {
+				return fmt.Errorf("seeding cache for %s: %w", entry.URL, err)
+			}
+			os.Remove(cachePath + ".meta")
+		}
+	}
+
+	for _, imp := range imports {
+		if current, err := os.ReadFile(imp.basefile); err == nil && bytes.Equal(current, imp.written) {
+			fmt.Printf("%s already up to date\n", imp.basefile)
+			continue
+		}
+		// written like an update, so e.g. 'manualReview' gets a .new file
+		var out fileOutput
+		_, err := writeBasefile(imp.upd, imp.basefile, imp.content, imp.written, &out)
+		out.flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cacheMeta is the .meta sidecar of a cache entry. It used to be plain
+// "ETag: ...\nLast-Modified: ...\n" lines, these are still understood.
+type cacheMeta struct {
+	URL          string `json:"url,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+
+	// BodySha256 is the hex sha256 of the body. The body lives in the
+	// content-addressable part of the cache (see casPathFor) if it exists
+	// there, else next to the meta.
+	BodySha256 string `json:"bodySha256,omitempty"`
+
+	// FetchedAt is when the body was last fetched, see -evict-older-than
+	FetchedAt time.Time `json:"fetchedAt,omitzero"`
+}
+
+func readCacheMeta(metaPath string) (cacheMeta, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return cacheMeta{}, err
+	}
+	return parseCacheMeta(data), nil
+}
+
+func parseCacheMeta(data []byte) cacheMeta {
+	var meta cacheMeta
+	if json.Unmarshal(data, &meta) == nil {
+		return meta
+	}
+
+	// old line based format
+	meta = cacheMeta{}
+	for _, l := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(l, "ETag: ") {
+			meta.ETag = strings.TrimPrefix(l, "ETag: ")
+		}
+		if strings.HasPrefix(l, "Last-Modified: ") {
+			meta.LastModified = strings.TrimPrefix(l, "Last-Modified: ")
+		}
+	}
+	return meta
+}
+
+// writeCacheMeta writes meta to a temporary file renamed over metaPath, so
+// concurrent readers never see a partially written meta
+func writeCacheMeta(metaPath string, meta cacheMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(metaPath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), metaPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// casPathFor returns where a body with the given hex sha256 is stored in the
+// content-addressable cache, so identical bodies served by different URLs
+// (e.g. mirrors) are only stored once
+func casPathFor(cacheDir, sum string) string {
+	return filepath.Join(cacheDir, "cas", sum)
+}
+
+// cacheBodyPath returns the file holding the cached body for the url-keyed
+// cachePath, which is the content-addressed one if meta points to it
+func cacheBodyPath(cacheDir, cachePath string, meta cacheMeta) string {
+	if meta.BodySha256 != "" {
+		casPath := casPathFor(cacheDir, meta.BodySha256)
+		if _, err := os.Stat(casPath); err == nil {
+			return casPath
+		}
+	}
+	return cachePath
+}
+
+// storeCacheBody streams body into the cache and returns where it ended up
+// plus its hex sha256. With contentAddressed the body is stored under its
+// hash, else at cachePath.
+func storeCacheBody(cacheDir, cachePath string, body io.Reader, contentAddressed bool) (string, string, error) {
+	tmpPath, sum, err := downloadCacheBody(cacheDir, body)
+	if err != nil {
+		return "", "", err
+	}
+	dest, err := commitCacheBody(cacheDir, cachePath, tmpPath, sum, contentAddressed)
+	return dest, sum, err
+}
+
+// downloadCacheBody streams body into a temporary file in cacheDir, returning
+// its path and hex sha256. It's up to the caller to commitCacheBody or remove it.
+func downloadCacheBody(cacheDir string, body io.Reader) (string, string, error) {
+	tmp, err := os.CreateTemp(cacheDir, ".tmp-*")
+	if err != nil {
+		return "", "", err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commitCacheBody moves a downloadCacheBody result into place, see storeCacheBody
+func commitCacheBody(cacheDir, cachePath, tmpPath, sum string, contentAddressed bool) (string, error) {
+	dest := cachePath
+	if contentAddressed {
+		dest = casPathFor(cacheDir, sum)
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return dest, nil
+}
+
+// migrateToCAS moves a url-keyed body at cachePath into the
+// content-addressable cache and points the meta at metaPath to it
+func migrateToCAS(cacheDir, cachePath, metaPath string, meta cacheMeta) (string, error) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return "", err
+	}
+	casPath, sum, err := storeCacheBody(cacheDir, cachePath, f, true)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("migrating %s to content-addressable cache: %w", cachePath, err)
+	}
+	meta.BodySha256 = sum
+	if err := writeCacheMeta(metaPath, meta); err != nil {
+		return cachePath, nil // keep using the url-keyed body
+	}
+	os.Remove(cachePath)
+	return casPath, nil
+}
+
+// invalidateCacheEntry removes the url-keyed entry at cachePath and its meta,
+// so a body that failed verification isn't served again. Content-addressed
+// bodies may be shared with other entries and are left to -evict-older-than.
+func invalidateCacheEntry(cachePath string) {
+	os.Remove(cachePath)
+	os.Remove(cachePath + ".meta")
+}
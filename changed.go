@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// filterChangedSince narrows updPaths down to the .upd files that, or whose
+// basefiles, changed between -changed-since and HEAD according to git. Outside
+// of a git work tree it warns and returns updPaths as they are.
+func filterChangedSince(projectRoot string, updPaths []string) ([]string, error) {
+	if err := exec.Command("git", "-C", projectRoot, "rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: -changed-since: %s is not in a git work tree, processing all .upd files\n", projectRoot)
+		return updPaths, nil
+	}
+
+	out, err := exec.Command("git", "-C", projectRoot, "diff", "--name-only", "--relative", flagChangedSince+"...HEAD", "--").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git diff %s...HEAD: %s", flagChangedSince, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git diff %s...HEAD: %w", flagChangedSince, err)
+	}
+	changed := map[string]bool{}
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name != "" {
+			changed[filepath.Join(projectRoot, filepath.FromSlash(name))] = true
+		}
+	}
+
+	var filtered []string
+	for _, updPath := range updPaths {
+		keep := changed[updPath]
+		if !keep {
+			if upd, err := loadUpdFile(updPath); err == nil {
+				basefile, err := basefileFor(updPath, upd)
+				keep = err == nil && changed[basefile]
+			}
+		}
+		if keep {
+			filtered = append(filtered, updPath)
+		}
+	}
+	verbosef("-changed-since %s: %d of %d .upd files changed\n", flagChangedSince, len(filtered), len(updPaths))
+	return filtered, nil
+}
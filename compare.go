@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// How upd decides whether a basefile already holds the fetched content,
+// set via -compare-mode or 'compareMode' of a .upd file:
+//
+//   - bytes: the content must be identical, or only differ in the lines of
+//     ignoreLines/ignoreHeaderLines (the default)
+//   - hash: compares the sha256 of the fetched content with a streamed
+//     sha256 of the basefile, so large basefiles aren't read into memory
+//     (ignoreLines/ignoreHeaderLines don't apply)
+//   - semantic: like bytes, but differences in line endings (CRLF vs LF)
+//     don't count either
+const (
+	compareBytes    = "bytes"
+	compareHash     = "hash"
+	compareSemantic = "semantic"
+)
+
+func validCompareMode(mode string) error {
+	switch mode {
+	case compareBytes, compareHash, compareSemantic:
+		return nil
+	}
+	return fmt.Errorf("invalid compare mode %q, expected %s, %s or %s", mode, compareBytes, compareHash, compareSemantic)
+}
+
+// compareModeFor returns the compare mode of upd, its 'compareMode' or else
+// -compare-mode
+func compareModeFor(upd UpdFile) string {
+	if upd.CompareMode != "" {
+		return upd.CompareMode
+	}
+	return flagCompareMode
+}
+
+// compareResult is what compareContent found
+type compareResult int
+
+const (
+	contentDiffers compareResult = iota
+	contentEqual
+	contentEquivalent // differs, but not in a way that counts for the compare mode
+)
+
+// compareContent compares the fetched content with basefile per mode, the
+// header of upd (if any) doesn't count
+func compareContent(mode string, content []byte, basefile string, upd UpdFile, ignoreRe *regexp.Regexp) (compareResult, error) {
+	if mode == compareHash && upd.Header == nil {
+		if _, err := os.Stat(basefile); err != nil {
+			return contentDiffers, nil // treat as empty if not exists
+		}
+		sum, err := fileSha256(basefile)
+		if err != nil {
+			return contentDiffers, fmt.Errorf("hashing %s: %w", basefile, err)
+		}
+		if sum == sha256Hex(content) {
+			return contentEqual, nil
+		}
+		return contentDiffers, nil
+	}
+
+	baseContent, err := os.ReadFile(basefile)
+	if err != nil {
+		baseContent = nil // treat as empty if not exists
+	}
+	if upd.Header != nil && baseContent != nil {
+		baseContent = upd.Header.strip(baseContent)
+	}
+	if bytes.Equal(content, baseContent) {
+		return contentEqual, nil
+	}
+	if baseContent == nil {
+		return contentDiffers, nil
+	}
+
+	normalize := func(b []byte) []byte {
+		if ignoreRe != nil || upd.IgnoreHeaderLines > 0 {
+			b = stripIgnoredLines(b, upd, ignoreRe)
+		}
+		if mode == compareSemantic {
+			b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+		}
+		return b
+	}
+	if (mode == compareSemantic || ignoreRe != nil || upd.IgnoreHeaderLines > 0) && bytes.Equal(normalize(content), normalize(baseContent)) {
+		return contentEquivalent, nil
+	}
+	return contentDiffers, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CONFIG_FILE_NAME is the optional project wide config in the project root.
+// It can be overlaid by CONFIG_FILE_NAME.<env>, selected via -env or $UPD_ENV
+// (-env wins). The overlay is deep-merged: maps are merged key by key,
+// scalars and lists of the overlay replace those of the base.
+const CONFIG_FILE_NAME = ".updconfig"
+
+// UpdConfig is the content of CONFIG_FILE_NAME
+type UpdConfig struct {
+	// BaseURL is what relative 'url' fields of .upd files are resolved against
+	BaseURL string `yaml:"baseURL"`
+
+	// DefaultHeaders are sent with every http(s) request, "${VAR}" in a value
+	// is replaced like in 'headers' of .upd files
+	DefaultHeaders map[string]string `yaml:"defaultHeaders"`
+
+	// AllowedHosts, if set, are the only hosts fetched from. An entry
+	// "*.example.com" allows all subdomains of example.com.
+	AllowedHosts []string `yaml:"allowedHosts"`
+
+	// AllowExtensions, if set, are the only extensions (e.g. ".txt" or
+	// ".tar.gz") basefiles may have, "" allows files without one.
+	// DenyExtensions are never written, even if allowed.
+	AllowExtensions []string `yaml:"allowExtensions"`
+	DenyExtensions  []string `yaml:"denyExtensions"`
+}
+
+var config UpdConfig
+
+// loadConfig reads CONFIG_FILE_NAME from projectRoot into config, overlaid
+// by the file for env (if any). A missing file for an explicitly requested
+// env (-env) is an error.
+func loadConfig(projectRoot, env string, explicitEnv bool) error {
+	merged := map[string]interface{}{}
+
+	basePath := filepath.Join(projectRoot, CONFIG_FILE_NAME)
+	base, err := readConfigMap(basePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	merged = deepMerge(merged, base)
+
+	if env != "" {
+		envPath := basePath + "." + env
+		overlay, err := readConfigMap(envPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && explicitEnv:
+			return fmt.Errorf("config for env %q not found: %s", env, envPath)
+		case errors.Is(err, fs.ErrNotExist):
+			verbosef("No config for env %q (%s)\n", env, envPath)
+		case err != nil:
+			return err
+		default:
+			merged = deepMerge(merged, overlay)
+		}
+	}
+
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	config = UpdConfig{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %w", CONFIG_FILE_NAME, err)
+	}
+	return nil
+}
+
+func readConfigMap(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// deepMerge merges overlay into base: nested maps are merged, everything
+// else of overlay replaces what's in base
+func deepMerge(base, overlay map[string]interface{}) map[string]interface{} {
+	for k, v := range overlay {
+		if vm, ok := v.(map[string]interface{}); ok {
+			if bm, ok := base[k].(map[string]interface{}); ok {
+				base[k] = deepMerge(bm, vm)
+				continue
+			}
+		}
+		base[k] = v
+	}
+	return base
+}
+
+// resolveURL resolves a relative rawURL against config.BaseURL
+func resolveURL(rawURL string) (string, error) {
+	if config.BaseURL == "" {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.IsAbs() {
+		return rawURL, nil
+	}
+	base, err := url.Parse(config.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing 'baseURL': %w", err)
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+// isAllowedHost reports whether host may be fetched from per config.AllowedHosts
+func isAllowedHost(host string) bool {
+	if len(config.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range config.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExtensionAllowed fails if config.AllowExtensions/DenyExtensions don't
+// permit writing basefile
+func checkExtensionAllowed(basefile string) error {
+	name := strings.ToLower(filepath.Base(basefile))
+	hasExt := func(ext string) bool {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if ext == "" {
+			return !strings.Contains(strings.TrimPrefix(name, "."), ".")
+		}
+		return strings.HasSuffix(name, "."+ext)
+	}
+
+	for _, ext := range config.DenyExtensions {
+		if hasExt(ext) {
+			return fmt.Errorf("refusing to write %s: extension %q is in 'denyExtensions' of %s", basefile, ext, CONFIG_FILE_NAME)
+		}
+	}
+	if len(config.AllowExtensions) == 0 {
+		return nil
+	}
+	for _, ext := range config.AllowExtensions {
+		if hasExt(ext) {
+			return nil
+		}
+	}
+	return fmt.Errorf("refusing to write %s: extension not in 'allowExtensions' of %s", basefile, CONFIG_FILE_NAME)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usedCachePaths are the url-keyed cache paths looked at during this run,
+// -evict-older-than leaves them alone however old they are
+var usedCachePaths sync.Map
+
+func markCacheUsed(cachePath string) {
+	usedCachePaths.Store(cachePath, true)
+}
+
+// evictCache removes the entries of cacheDir last fetched before olderThan
+// ago and not used during this run (-evict-older-than), plus the
+// content-addressed bodies no remaining entry points to. Entries without a
+// 'fetchedAt' (older meta, or -no-meta bodies) are aged by their mod time.
+// It returns the number of evicted entries.
+func evictCache(cacheDir string, olderThan time.Duration) (int, error) {
+	dirEntries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+
+	evicted := 0
+	referenced := map[string]bool{} // hex sha256 of the bodies still needed
+	for _, e := range dirEntries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+		path := filepath.Join(cacheDir, name)
+		cachePath, isMeta := strings.CutSuffix(path, ".meta")
+		if !isMeta {
+			if _, err := os.Stat(path + ".meta"); err == nil {
+				continue // handled along with its meta
+			}
+		}
+
+		var fetchedAt time.Time
+		var meta cacheMeta
+		if isMeta {
+			meta, _ = readCacheMeta(path)
+			fetchedAt = meta.FetchedAt
+		}
+		if fetchedAt.IsZero() {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			fetchedAt = info.ModTime()
+		}
+
+		if _, used := usedCachePaths.Load(cachePath); used || !fetchedAt.Before(cutoff) {
+			if meta.BodySha256 != "" {
+				referenced[meta.BodySha256] = true
+			}
+			continue
+		}
+		verbosef("evicting cache entry %s (%s)\n", cachePath, meta.URL)
+		os.Remove(cachePath)
+		if isMeta {
+			os.Remove(path)
+		}
+		evicted++
+	}
+
+	casEntries, err := os.ReadDir(filepath.Join(cacheDir, "cas"))
+	if err != nil && !os.IsNotExist(err) {
+		return evicted, err
+	}
+	for _, e := range casEntries {
+		if !e.IsDir() && !referenced[e.Name()] {
+			os.Remove(filepath.Join(cacheDir, "cas", e.Name()))
+		}
+	}
+	return evicted, nil
+}
+
+// evictOldCacheEntries runs evictCache on the default cache dir for
+// -evict-older-than and reports the result, unless -summary-only
+func evictOldCacheEntries() {
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Evicting cache entries: %v\n", err)
+		return
+	}
+	n, err := evictCache(cacheDir, flagEvictOlderThan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Evicting cache entries: %v\n", err)
+	}
+	if !flagSummaryOnly {
+		fmt.Printf("Evicted %d cache entries last fetched over %s ago\n", n, flagEvictOlderThan)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FetchRequest describes a single URL to fetch
+type FetchRequest struct {
+	CacheDir string
+	URL      string
+
+	// UnixSocket makes http(s) requests dial this socket instead of the host of URL
+	UnixSocket string
+
+	// Headers are sent along with http(s) requests
+	Headers map[string]string
+
+	// RangeHashes is the URL of a range-hash manifest of URL, see
+	// fetchWithRangeHashes. RangeSeed is a local copy to reuse chunks of.
+	RangeHashes string
+	RangeSeed   string
+
+	// Timings, if non-nil, get the network phases of the fetch added (-profile)
+	Timings *phaseTimings
+}
+
+// cacheKey identifies the cached body of r, the same URL served over
+// different sockets may well be different content
+func (r FetchRequest) cacheKey() string {
+	if r.UnixSocket != "" {
+		return "unix:" + r.UnixSocket + "|" + r.URL
+	}
+	return r.URL
+}
+
+// FetchResult tells where the fetched body can be read from
+type FetchResult struct {
+	Path     string // file holding the body
+	CacheHit bool   // body was served from the cache
+
+	// Reason tells how the body was arrived at, see -explain-cache
+	Reason string
+}
+
+// Fetcher retrieves the body of a URL, implementing whatever caching makes
+// sense for its scheme
+type Fetcher interface {
+	Fetch(req FetchRequest) (FetchResult, error)
+}
+
+// fetchers maps URL schemes to their Fetcher
+var fetchers = map[string]Fetcher{}
+
+func registerFetcher(scheme string, f Fetcher) {
+	fetchers[scheme] = f
+}
+
+func init() {
+	registerFetcher("http", httpFetcher{})
+	registerFetcher("https", httpFetcher{})
+	registerFetcher("file", fileFetcher{})
+}
+
+// fetchURL dispatches req to the Fetcher registered for the scheme of req.URL
+func fetchURL(req FetchRequest) (FetchResult, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	f, ok := fetchers[strings.ToLower(u.Scheme)]
+	if !ok {
+		return FetchResult{}, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	if u.Host != "" && !isAllowedHost(u.Hostname()) {
+		return FetchResult{}, fmt.Errorf("host %s is not in 'allowedHosts' of %s", u.Hostname(), CONFIG_FILE_NAME)
+	}
+
+	m, loaded := fetchMemo.LoadOrStore(req.memoKey(), &memoizedFetch{})
+	memo := m.(*memoizedFetch)
+	if loaded {
+		verbosef("%s: already fetched during this run\n", req.URL)
+	}
+	memo.once.Do(func() { memo.res, memo.err = f.Fetch(req) })
+	res := memo.res
+	if loaded {
+		res.Reason = "already fetched during this run: " + res.Reason
+	}
+	return res, memo.err
+}
+
+// fetchMemo holds a *memoizedFetch per FetchRequest.memoKey, so .upd files
+// sharing a URL only fetch it once per run (see resetFetchMemo)
+var fetchMemo sync.Map
+
+// memoKey tells requests apart that may get different responses: besides
+// the cache dir and cacheKey, the headers sent and the range-hash manifest
+func (r FetchRequest) memoKey() string {
+	var b strings.Builder
+	b.WriteString(r.CacheDir + "|" + r.cacheKey() + "|" + r.RangeHashes)
+	for _, name := range slices.Sorted(maps.Keys(r.Headers)) {
+		b.WriteString("|" + name + ": " + r.Headers[name])
+	}
+	return b.String()
+}
+
+type memoizedFetch struct {
+	once sync.Once
+	res  FetchResult
+	err  error
+}
+
+// resetFetchMemo forgets what was fetched, -watch does so before each sync
+func resetFetchMemo() {
+	fetchMemo.Clear()
+}
+
+// defaultCacheDir is ~/.cache/upd/urlcache, unless -cache-dir
+func defaultCacheDir() (string, error) {
+	if flagCacheDir != "" {
+		return filepath.Abs(flagCacheDir)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine home directory: %w", err)
+	}
+	return filepath.Join(home, ".cache", "upd", "urlcache"), nil
+}
+
+// cachePathFor returns where the body for a FetchRequest.cacheKey is cached: sha256(key).ext
+func cachePathFor(cacheDir, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	ext := filepath.Ext(key)
+	if ext == "" || len(ext) > 8 {
+		ext = ".dat"
+	}
+	return filepath.Join(cacheDir, hex.EncodeToString(hash[:])+ext)
+}
+
+// fileFetcher serves file:// URLs straight from disk, there's nothing to cache
+type fileFetcher struct{}
+
+func (fileFetcher) Fetch(req FetchRequest) (FetchResult, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return FetchResult{}, fmt.Errorf("file url %s must not name a remote host", req.URL)
+	}
+	p := filepath.FromSlash(u.Path)
+	if _, err := os.Stat(p); err != nil {
+		return FetchResult{}, err
+	}
+	return FetchResult{Path: p, Reason: "file url, read from disk, nothing cached"}, nil
+}
+
+// httpFetcher serves http:// and https:// URLs via fetchWithCache
+type httpFetcher struct{}
+
+func (httpFetcher) Fetch(req FetchRequest) (FetchResult, error) {
+	if res, ok, err := fetchFromCacheOnly(req); ok || err != nil {
+		return res, err
+	}
+	if req.RangeHashes != "" {
+		res, err := fetchWithRangeHashes(req)
+		var tooLarge *downloadTooLargeError
+		if err == nil || errors.As(err, &tooLarge) {
+			return res, err
+		}
+		verbosef("%s: %v, falling back to a full fetch\n", req.URL, err)
+		res, fullErr := fetchWithCache(req)
+		res.Reason = fmt.Sprintf("range-hash fetch failed (%v), %s", err, res.Reason)
+		return res, fullErr
+	}
+	return fetchWithCache(req)
+}
+
+// fetchFromCacheOnly serves fr from the cache without any request: always
+// with -offline (failing if it was never cached), else while the entry was
+// last fetched less than -max-age ago. ok is false if a request is needed.
+func fetchFromCacheOnly(fr FetchRequest) (res FetchResult, ok bool, err error) {
+	if !flagOffline && (flagMaxAge <= 0 || flagForce) {
+		return FetchResult{}, false, nil
+	}
+	cachePath := cachePathFor(fr.CacheDir, fr.cacheKey())
+	var meta cacheMeta
+	if !flagNoMeta {
+		meta, _ = readCacheMeta(cachePath + ".meta")
+	}
+	bodyPath := cacheBodyPath(fr.CacheDir, cachePath, meta)
+	if _, err := os.Stat(bodyPath); err != nil {
+		if flagOffline {
+			return FetchResult{}, false, errors.New("never fetched into the cache, can't get it with -offline")
+		}
+		return FetchResult{}, false, nil
+	}
+	markCacheUsed(cachePath)
+
+	if flagOffline {
+		return FetchResult{Path: bodyPath, CacheHit: true, Reason: "-offline, served cache " + bodyPath}, true, nil
+	}
+	if age := time.Since(meta.FetchedAt); !meta.FetchedAt.IsZero() && age < flagMaxAge {
+		reason := fmt.Sprintf("last fetched %s ago, within -max-age %s, served cache %s", age.Round(time.Second), flagMaxAge, bodyPath)
+		return FetchResult{Path: bodyPath, CacheHit: true, Reason: reason}, true, nil
+	}
+	return FetchResult{}, false, nil
+}
+
+// resolveOverrides maps host names to the IP to connect to instead of
+// resolving them, see -resolve
+var resolveOverrides = map[string]string{}
+
+// parseResolveOverrides parses -resolve "host:ip" values into resolveOverrides
+func parseResolveOverrides(values []string) error {
+	for _, v := range values {
+		host, ip, ok := strings.Cut(v, ":")
+		ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid -resolve %q, expected host:ip", v)
+		}
+		resolveOverrides[strings.ToLower(host)] = ip
+	}
+	return nil
+}
+
+// parseDNSServer validates a -dns-server "ip[:port]", returning it with the
+// port (default 53)
+func parseDNSServer(v string) (string, error) {
+	host, port, err := net.SplitHostPort(v)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(v, "["), "]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid -dns-server %q, expected ip[:port]", v)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// dialViaDNSServer dials addr resolving its host with -dns-server instead of
+// the system resolver, trying each address it returns
+func dialViaDNSServer(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, flagDNSServer)
+		},
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("-dns-server %s has no address for %s", flagDNSServer, host)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// tlsVersions are the values of -tls-min-version
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// modernCipherSuites are the TLS 1.2 cipher suites of -tls-modern-ciphers:
+// forward secrecy and authenticated encryption only
+var modernCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsPolicy returns the TLS config of -tls-min-version and -tls-modern-ciphers
+func tlsPolicy() *tls.Config {
+	cfg := &tls.Config{MinVersion: tlsVersions[flagTLSMinVersion]}
+	if flagTLSModernCiphers {
+		cfg.CipherSuites = modernCipherSuites
+	}
+	return cfg
+}
+
+// tlsPolicyError tells that a TLS handshake with host failed in a way the
+// TLS policy may be to blame for: no common version or cipher suite
+func tlsPolicyError(host string, err error) error {
+	msg := err.Error()
+	var opErr *net.OpError
+	serverRefused := errors.As(err, &opErr) && opErr.Op == "remote error" &&
+		(strings.Contains(msg, "protocol version") || strings.Contains(msg, "handshake failure") || strings.Contains(msg, "insufficient security"))
+	if !serverRefused && !strings.Contains(msg, "tls: server selected unsupported protocol version") {
+		return nil
+	}
+	policy := "-tls-min-version " + flagTLSMinVersion
+	if flagTLSModernCiphers {
+		policy += " -tls-modern-ciphers"
+	}
+	return fmt.Errorf("%s doesn't meet the TLS policy (%s): %w", host, policy, err)
+}
+
+// newHTTPClient returns the client to fetch fr with.
+//
+// Instead of one overall deadline, each phase of a request has its own:
+// connecting (-connect-timeout), the TLS handshake (-tls-timeout) and waiting
+// for the response headers (-response-header-timeout). Reading the body is
+// only limited by -timeout, which is off by default so large downloads over
+// slow but healthy connections aren't killed.
+func newHTTPClient(fr FetchRequest) *http.Client {
+	dialer := &net.Dialer{Timeout: flagConnectTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// -resolve only changes what is dialed, Host header and TLS SNI
+		// still use the host of the URL
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := resolveOverrides[strings.ToLower(host)]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		var dnsErr *net.DNSError
+		if err != nil && flagDNSServer != "" && errors.As(err, &dnsErr) {
+			verbosef("%v, retrying via -dns-server %s\n", err, flagDNSServer)
+			return dialViaDNSServer(ctx, dialer, network, addr)
+		}
+		return conn, err
+	}
+	transport.TLSClientConfig = tlsPolicy()
+	transport.TLSHandshakeTimeout = flagTLSTimeout
+	transport.ResponseHeaderTimeout = flagResponseHeaderTimeout
+	if fr.UnixSocket != "" {
+		socket := fr.UnixSocket
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	var rt http.RoundTripper = transport
+	switch {
+	case flagRecord != "":
+		rt = &recordingTransport{next: transport, dir: flagRecord, fr: fr}
+	case flagReplay != "":
+		rt = &replayTransport{dir: flagReplay, fr: fr}
+	}
+	return &http.Client{Timeout: flagTimeout, Transport: rt}
+}
+
+// fetchWithCache caches URLs by sha256(url).ext, respects ETag/Last-Modified if possible
+func fetchWithCache(fr FetchRequest) (FetchResult, error) {
+	cachePath := cachePathFor(fr.CacheDir, fr.cacheKey())
+	metaPath := cachePath + ".meta"
+	markCacheUsed(cachePath)
+
+	// If cache exists, try conditional GET. -no-meta is for debugging the
+	// caching: always a plain GET, the body is still cached (url-keyed, as
+	// without meta nothing would point to a content-addressed one) but meta
+	// is neither read nor written.
+	var meta cacheMeta
+	if !flagNoMeta {
+		meta, _ = readCacheMeta(metaPath)
+	}
+	contentAddressed := flagContentAddressed && !flagNoMeta
+	bodyPath := cacheBodyPath(fr.CacheDir, cachePath, meta)
+	if contentAddressed && bodyPath == cachePath {
+		if _, err := os.Stat(cachePath); err == nil {
+			// transparently move a body of the old url-keyed layout
+			meta.URL = fr.URL
+			if casPath, err := migrateToCAS(fr.CacheDir, cachePath, metaPath, meta); err == nil {
+				bodyPath = casPath
+			}
+		}
+	}
+
+	if flagRemoteCache != "" && !flagNoMeta && !flagForce {
+		if _, err := os.Stat(bodyPath); err != nil {
+			if remoteBodyPath, ok := fetchFromRemoteCache(fr, cachePath, metaPath); ok {
+				return FetchResult{Path: remoteBodyPath, CacheHit: true, Reason: "not in the local cache, served from -remote-cache"}, nil
+			}
+		}
+	}
+
+	client := newHTTPClient(fr)
+	req, err := http.NewRequest("GET", fr.URL, nil)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	if fr.Timings != nil {
+		req = req.WithContext(fr.Timings.withTrace(req.Context()))
+	}
+	for k, v := range fr.Headers {
+		req.Header.Set(k, v)
+	}
+	if meta.ETag != "" && !flagForce {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" && !flagForce {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	var conditional []string
+	for _, h := range []string{"If-None-Match", "If-Modified-Since"} {
+		if v := req.Header.Get(h); v != "" {
+			conditional = append(conditional, h+": "+v)
+		}
+	}
+
+	resp, err := doWithRetries(client, req)
+	if err != nil {
+		if policyErr := tlsPolicyError(req.URL.Hostname(), err); policyErr != nil {
+			return FetchResult{}, policyErr // no falling back to the cache for these
+		}
+		// If we can't reach the server, use cache if available
+		if _, statErr := os.Stat(bodyPath); statErr == nil {
+			return FetchResult{Path: bodyPath, CacheHit: true, Reason: fmt.Sprintf("request failed (%v), served cache %s", err, bodyPath)}, nil
+		}
+		return FetchResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := checkDownloadSize(fr.URL, resp.ContentLength); err != nil {
+			return FetchResult{}, err
+		}
+		downloadStart := time.Now()
+		tmpPath, sum, err := downloadCacheBody(fr.CacheDir, limitDownload(fr.URL, resp.Body))
+		if err != nil {
+			return FetchResult{}, err
+		}
+		if fr.Timings != nil {
+			fr.Timings.Download += time.Since(downloadStart)
+		}
+		var reason string
+		switch {
+		case flagNoMeta:
+			reason = "-no-meta, plain GET"
+		case flagForce && (meta.ETag != "" || meta.LastModified != ""):
+			reason = "-force, plain GET despite a cache entry"
+		case len(conditional) > 0:
+			reason = "200 OK despite " + strings.Join(conditional, ", ")
+		case meta.BodySha256 != "":
+			reason = "200 OK, cache entry has no validators for a conditional GET"
+		default:
+			reason = "not cached, 200 OK"
+		}
+		if _, statErr := os.Stat(bodyPath); statErr == nil && sum == meta.BodySha256 {
+			// e.g. servers that never answer 304, keep the cache file as is
+			os.Remove(tmpPath)
+			verbosef("%s: content identical despite 200\n", fr.URL)
+			reason += ", body identical to cache " + bodyPath
+		} else {
+			bodyPath, err = commitCacheBody(fr.CacheDir, cachePath, tmpPath, sum, contentAddressed)
+			if err != nil {
+				return FetchResult{}, err
+			}
+			reason += ", fetched fresh into " + bodyPath
+		}
+		meta := cacheMeta{
+			URL:          fr.URL,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			BodySha256:   sum,
+			FetchedAt:    time.Now(),
+		}
+		if flagNoMeta {
+			return FetchResult{Path: bodyPath, Reason: reason}, nil
+		}
+		if bodyPath != cachePath {
+			os.Remove(cachePath) // superseded by the content-addressed body
+		}
+		_ = writeCacheMeta(metaPath, meta)
+		if flagRemoteCache != "" && flagCachePush {
+			pushToRemoteCache(cachePath, bodyPath, metaPath)
+		}
+		return FetchResult{Path: bodyPath, Reason: reason}, nil
+	case http.StatusNotModified:
+		// Use cache, it's as fresh as a new fetch now (see -max-age)
+		if !flagNoMeta {
+			meta.FetchedAt = time.Now()
+			_ = writeCacheMeta(metaPath, meta)
+		}
+		return FetchResult{Path: bodyPath, CacheHit: true, Reason: fmt.Sprintf("304 Not Modified (%s), served cache %s", strings.Join(conditional, ", "), bodyPath)}, nil
+	default:
+		return FetchResult{}, fmt.Errorf("http error: %s", resp.Status)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runFix repairs what interrupted runs and upgrades leave behind in the
+// cache and the project, reporting every action (or with -dry-run only what
+// it would do):
+//
+//   - leftover temporary files in the cache are removed
+//   - cache bodies that don't match the sha256 in their meta, or are empty
+//     without a meta saying so, are removed along with their meta
+//   - content-addressed bodies not matching their name are removed
+//   - old line based meta files are rewritten as JSON
+//   - bodies of known .upd files without meta get a new one, see fixMissingMeta
+//   - <basefile>.new and <basefile>.bak files whose basefile no longer
+//     exists and no .upd file refers to anymore are removed, as are .new
+//     files of 'manualReview' that have been copied into place already
+func runFix(projectRoot string, args []string) int {
+	fs := flag.NewFlagSet("fix", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only print what would be fixed")
+	fs.Parse(args)
+
+	updPaths, err := findUpdFiles(projectRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		return 1
+	}
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	f := &fixer{dryRun: *dryRun}
+
+	// the requests of all .upd files by their cache path, to tell cache
+	// entries without meta what URL they're for
+	requests := map[string]FetchRequest{}
+	basefiles := map[string]bool{}
+	var reviewed []string // basefiles of 'manualReview'
+	for _, updPath := range updPaths {
+		upd, err := loadUpdFile(updPath)
+		if err != nil {
+			continue
+		}
+		if basefile, err := basefileFor(updPath, upd); err == nil {
+			basefiles[basefile] = true
+			if upd.ManualReview {
+				reviewed = append(reviewed, basefile)
+			}
+		}
+		if fr, err := fetchRequestFor(cacheDir, upd); err == nil {
+			requests[cachePathFor(cacheDir, fr.cacheKey())] = fr
+		} else {
+			verbosef("%s: %v, not regenerating its meta\n", updPath, err)
+		}
+	}
+
+	if _, err := os.Stat(cacheDir); err == nil {
+		f.fixCache(cacheDir, requests)
+	}
+	if err := f.fixOrphanedSidecars(projectRoot, basefiles); err != nil {
+		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		f.failed = true
+	}
+	f.fixAppliedReviews(reviewed)
+
+	switch {
+	case f.failed:
+		return 1
+	case f.actions == 0:
+		fmt.Printf("Nothing to fix\n")
+	}
+	return 0
+}
+
+type fixer struct {
+	dryRun  bool
+	actions int
+	failed  bool
+}
+
+// do runs fix unless -dry-run, reporting what (e.g. "remove x") would be
+// done or done (e.g. "Removed x") once fix succeeded
+func (f *fixer) do(what, done string, fix func() error) {
+	f.actions++
+	if f.dryRun {
+		fmt.Printf("Would %s\n", what)
+		return
+	}
+	if err := fix(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: couldn't %s: %v\n", what, err)
+		f.failed = true
+		return
+	}
+	fmt.Printf("%s\n", done)
+}
+
+func (f *fixer) fixCache(cacheDir string, requests map[string]FetchRequest) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		f.failed = true
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(cacheDir, name)
+		switch {
+		case e.IsDir():
+			continue
+		case strings.HasPrefix(name, ".tmp-"):
+			f.do("remove leftover temporary file "+path, "Removed leftover temporary file "+path, func() error { return os.Remove(path) })
+		case strings.HasSuffix(name, ".meta"):
+			f.fixMeta(cacheDir, path, requests)
+		default:
+			if _, err := os.Stat(path + ".meta"); os.IsNotExist(err) {
+				f.fixMissingMeta(path, requests)
+			}
+		}
+	}
+
+	casEntries, _ := os.ReadDir(filepath.Join(cacheDir, "cas"))
+	for _, e := range casEntries {
+		path := filepath.Join(cacheDir, "cas", e.Name())
+		if sum, err := fileSha256(path); err == nil && sum != e.Name() {
+			f.do("remove corrupt content-addressed body "+path, "Removed corrupt content-addressed body "+path, func() error { return os.Remove(path) })
+		}
+	}
+}
+
+// fixMeta converts an old format meta at metaPath and removes the entry if
+// its body is corrupt
+func (f *fixer) fixMeta(cacheDir, metaPath string, requests map[string]FetchRequest) {
+	cachePath := strings.TrimSuffix(metaPath, ".meta")
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return
+	}
+	meta := parseCacheMeta(data)
+
+	bodyPath := cacheBodyPath(cacheDir, cachePath, meta)
+	if info, err := os.Stat(bodyPath); err == nil {
+		corrupt := info.Size() == 0 && meta.BodySha256 == ""
+		if meta.BodySha256 != "" {
+			sum, err := fileSha256(bodyPath)
+			corrupt = err == nil && !strings.EqualFold(sum, meta.BodySha256)
+		}
+		if corrupt {
+			f.do("remove corrupt cache entry "+cachePath, "Removed corrupt cache entry "+cachePath, func() error {
+				os.Remove(bodyPath)
+				return os.Remove(metaPath)
+			})
+			return
+		}
+	}
+
+	if !json.Valid(data) {
+		if meta.URL == "" {
+			meta.URL = requests[cachePath].URL
+		}
+		f.do("convert old format meta "+metaPath+" to JSON", "Converted old format meta "+metaPath+" to JSON", func() error { return writeCacheMeta(metaPath, meta) })
+	}
+}
+
+// fixMissingMeta writes a meta for the cache body at cachePath, as far as
+// it's known which URL it belongs to. Its validators are taken from a HEAD
+// request where they're known to describe the cached body: a Last-Modified
+// that isn't newer than the body. An ETag can't be told apart from one of a
+// newer upstream version, so it's left out, the next run then does a plain
+// GET and simply finds the body unchanged. With -offline there's no HEAD
+// request and so no validators at all.
+func (f *fixer) fixMissingMeta(cachePath string, requests map[string]FetchRequest) {
+	fr, ok := requests[cachePath]
+	if !ok {
+		return // no idea which URL this is for
+	}
+	if u, err := url.Parse(fr.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+
+	f.do("regenerate meta of "+cachePath+" ("+fr.URL+")", "Regenerated meta of "+cachePath+" ("+fr.URL+")", func() error {
+		info, err := os.Stat(cachePath)
+		if err != nil {
+			return err
+		}
+		sum, err := fileSha256(cachePath)
+		if err != nil {
+			return err
+		}
+		meta := cacheMeta{URL: fr.URL, BodySha256: sum, FetchedAt: info.ModTime()}
+		if flagOffline {
+			return writeCacheMeta(cachePath+".meta", meta) // no validators without asking upstream
+		}
+
+		req, err := http.NewRequest("HEAD", fr.URL, nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range fr.Headers {
+			req.Header.Set(k, v)
+		}
+		if resp, err := newHTTPClient(fr).Do(req); err != nil {
+			verbosef("HEAD %s: %v\n", fr.URL, err)
+		} else {
+			resp.Body.Close()
+			lastModified := resp.Header.Get("Last-Modified")
+			if t, err := http.ParseTime(lastModified); resp.StatusCode == http.StatusOK && err == nil && !t.After(info.ModTime()) {
+				meta.LastModified = lastModified
+			}
+		}
+		return writeCacheMeta(cachePath+".meta", meta)
+	})
+}
+
+// sidecarSuffixes are the files next to a basefile fixOrphanedSidecars
+// looks at
+var sidecarSuffixes = []string{".new", ".bak"}
+
+// fixOrphanedSidecars removes the <basefile>.new and <basefile>.bak files
+// below projectRoot whose basefile is gone and isn't the basefile of any of
+// the .upd files anymore (a .new of 'manualReview' for a file that doesn't
+// exist yet still awaits review). Like findUpdFiles it leaves out what
+// .updignore ignores, and it never descends into .git and node_modules.
+func (f *fixer) fixOrphanedSidecars(projectRoot string, basefiles map[string]bool) error {
+	patterns, err := loadIgnorePatterns(projectRoot)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(projectRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, relErr := filepath.Rel(projectRoot, path)
+		if relErr == nil && rel != "." && ignored(patterns, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if name := d.Name(); rel != "." && (name == ".git" || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, suffix := range sidecarSuffixes {
+			basefile, ok := strings.CutSuffix(path, suffix)
+			if !ok || basefiles[basefile] {
+				continue
+			}
+			if _, err := os.Lstat(basefile); os.IsNotExist(err) {
+				f.do("remove orphaned "+path, "Removed orphaned "+path, func() error { return os.Remove(path) })
+			}
+		}
+		return nil
+	})
+}
+
+// fixAppliedReviews removes the <basefile>.new files of the 'manualReview'
+// basefiles that are the same as their basefile, i.e. they've been reviewed
+// and copied into place
+func (f *fixer) fixAppliedReviews(basefiles []string) {
+	for _, basefile := range basefiles {
+		newPath := basefile + ".new"
+		pending, err := os.ReadFile(newPath)
+		if err != nil {
+			continue
+		}
+		if content, err := os.ReadFile(basefile); err == nil && bytes.Equal(content, pending) {
+			f.do("remove already applied "+newPath, "Removed already applied "+newPath, func() error { return os.Remove(newPath) })
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	goVersionOnce sync.Once
+	goVersion     string
+	goVersionErr  error
+)
+
+// currentGoVersion returns the version of the 'go' in PATH, e.g. "1.24.5"
+func currentGoVersion() (string, error) {
+	goVersionOnce.Do(func() {
+		out, err := exec.Command("go", "version").Output()
+		if err != nil {
+			goVersionErr = fmt.Errorf("running 'go version': %w", err)
+			return
+		}
+		// e.g. "go version go1.24.5 linux/amd64"
+		m := regexp.MustCompile(`\bgo(\d+(?:\.\d+)*)`).FindStringSubmatch(string(out))
+		if m == nil {
+			goVersionErr = fmt.Errorf("unexpected 'go version' output: %q", strings.TrimSpace(string(out)))
+			return
+		}
+		goVersion = m[1]
+	})
+	return goVersion, goVersionErr
+}
+
+// compareVersions compares dotted numeric versions, missing components count
+// as 0, so "1.21" == "1.21.0"
+func compareVersions(a, b string) (int, error) {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		var err error
+		if i < len(as) {
+			if x, err = strconv.Atoi(as[i]); err != nil {
+				return 0, fmt.Errorf("invalid version %q", a)
+			}
+		}
+		if i < len(bs) {
+			if y, err = strconv.Atoi(bs[i]); err != nil {
+				return 0, fmt.Errorf("invalid version %q", b)
+			}
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// satisfiesVersionConstraint reports whether version matches constraint, a
+// comma separated list of clauses that all have to hold, each an operator
+// (>=, >, <=, <, ==, !=; none means ==) followed by a version such as
+// ">=1.21, <1.23". A leading "go" on versions is ignored.
+func satisfiesVersionConstraint(version, constraint string) (bool, error) {
+	for _, clause := range strings.Split(constraint, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		op := "=="
+		for _, candidate := range []string{">=", "<=", "==", "!=", ">", "<", "="} {
+			if strings.HasPrefix(clause, candidate) {
+				op = candidate
+				clause = strings.TrimSpace(strings.TrimPrefix(clause, candidate))
+				break
+			}
+		}
+		cmp, err := compareVersions(version, strings.TrimPrefix(clause, "go"))
+		if err != nil {
+			return false, fmt.Errorf("parsing constraint %q: %w", constraint, err)
+		}
+		var ok bool
+		switch op {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
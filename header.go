@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// headerMarker is the first line of every provenance header, after the
+// comment prefix
+const headerMarker = "Managed by upd (" + UPD_LINK_URL + "), do not edit manually"
+
+// defaultHeaderTemplate is used if a 'header' doesn't set a template
+const defaultHeaderTemplate = "Source: {url}\nFetched: {date}"
+
+// HeaderConfig makes upd prepend a comment header noting where a basefile
+// comes from. It's the headerMarker line plus the lines of Template, each
+// prefixed with Prefix (e.g. "# " or "// "). In Template "{url}" is replaced
+// with the URL and "{date}" with the (UTC) date the content was written.
+//
+// The header is stripped off the basefile before comparing, so it only
+// changes along with the content. Binary content gets no header.
+type HeaderConfig struct {
+	Prefix   string `yaml:"prefix"`
+	Template string `yaml:"template"`
+}
+
+func (h HeaderConfig) lines() []string {
+	template := h.Template
+	if template == "" {
+		template = defaultHeaderTemplate
+	}
+	return append([]string{headerMarker}, strings.Split(strings.TrimSuffix(template, "\n"), "\n")...)
+}
+
+// render returns the header for content fetched from url
+func (h HeaderConfig) render(url string, now time.Time) []byte {
+	r := strings.NewReplacer("{url}", url, "{date}", now.UTC().Format("2006-01-02"))
+	var b bytes.Buffer
+	for _, l := range h.lines() {
+		b.WriteString(strings.TrimRight(h.Prefix+r.Replace(l), " "))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// strip returns content without its header, content as is if it doesn't
+// start with one
+func (h HeaderConfig) strip(content []byte) []byte {
+	marker := strings.TrimRight(h.Prefix+headerMarker, " ") + "\n"
+	if !bytes.HasPrefix(content, []byte(marker)) {
+		return content
+	}
+	rest := content
+	for range h.lines() {
+		_, after, found := bytes.Cut(rest, []byte("\n"))
+		if !found {
+			return content
+		}
+		rest = after
+	}
+	return rest
+}
+
+// isBinary guesses whether content is binary, as text has no NUL bytes
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), 8000)], 0) >= 0
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// updignoreTemplate is what `upd ignore init` writes
+const updignoreTemplate = `# .updignore
+#
+# This file marks the project root: upd searches upwards from the current
+# directory for it and looks for .upd files below the directory containing
+# it. Without one, the current directory is used.
+#
+# Every other line is a gitignore-style pattern of paths (relative to the
+# project root) to leave out of the search for .upd files: a leading "/"
+# anchors a pattern to the root, a trailing "/" only matches directories,
+# "*" and "?" don't match "/" while "**" does. Patterns without a "/" match
+# at any depth. A leading "!" brings back what an earlier pattern left out,
+# the last matching pattern wins; nothing below a left out directory can be
+# brought back though. Empty lines and lines starting with "#" are ignored,
+# e.g.:
+#
+# vendor/
+# node_modules/
+# /testdata/
+# *.bak.upd
+# !keep.bak.upd
+`
+
+// ignorePattern is a parsed line of .updignore
+type ignorePattern struct {
+	re       *regexp.Regexp
+	dirOnly  bool // trailing "/"
+	basename bool // no "/", matches the last path element at any depth
+	negate   bool // leading "!"
+}
+
+// loadIgnorePatterns reads the patterns of the .updignore in projectRoot,
+// none if there is no .updignore
+func loadIgnorePatterns(projectRoot string) ([]ignorePattern, error) {
+	data, err := os.ReadFile(filepath.Join(projectRoot, ".updignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []ignorePattern
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		line, p.negate = strings.CutPrefix(line, "!")
+		line, p.dirOnly = strings.CutSuffix(line, "/")
+		anchored := strings.HasPrefix(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		p.basename = !anchored && !strings.Contains(line, "/")
+		re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+		if err != nil {
+			return nil, fmt.Errorf(".updignore: invalid pattern %q: %w", line, err)
+		}
+		p.re = re
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// globToRegexp translates a gitignore glob to a regular expression
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(glob[i:], ']'); end > 0 {
+				class := glob[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += end
+			} else {
+				b.WriteString(`\[`)
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// ignored tells whether rel (slash separated, relative to the project root)
+// is left out by patterns, i.e. the last of them matching it isn't negated
+func ignored(patterns []ignorePattern, rel string, isDir bool) bool {
+	ignore := false
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		target := rel
+		if p.basename {
+			target = path.Base(rel)
+		}
+		if p.re.MatchString(target) {
+			ignore = !p.negate
+		}
+	}
+	return ignore
+}
+
+// runIgnore implements `upd ignore <subcommand>`
+func runIgnore(args []string) int {
+	if len(args) == 0 || args[0] != "init" {
+		fmt.Fprintf(os.Stderr, "Usage: upd ignore init [-force]\n")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ignore init", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite an existing .updignore")
+	fs.Parse(args[1:])
+
+	path, err := filepath.Abs(".updignore")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists (use -force to overwrite it)\n", path)
+		return 1
+	}
+	if err := os.WriteFile(path, []byte(updignoreTemplate), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Created %s\n", path)
+	return 0
+}
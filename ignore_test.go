@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		match   []string
+		noMatch []string
+	}{
+		{"vendor", []string{"vendor"}, []string{"vendors", "a/vendor"}},
+		{"*.upd", []string{"x.upd", ".upd"}, []string{"a/x.upd", "x.upd.bak"}},
+		{"a?c", []string{"abc"}, []string{"ac", "a/c"}},
+		{"**/x.upd", []string{"x.upd", "a/x.upd", "a/b/x.upd"}, []string{"ax.upd"}},
+		{"a/**", []string{"a/b", "a/b/c"}, []string{"b/a"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"a/xb"}},
+		{"[ab].upd", []string{"a.upd", "b.upd"}, []string{"c.upd"}},
+		{"[!ab].upd", []string{"c.upd"}, []string{"a.upd"}},
+		{"[ab", []string{"[ab"}, []string{"a"}},
+		{"a.b+c", []string{"a.b+c"}, []string{"axb+c", "a.bbc"}},
+	}
+	for _, tt := range tests {
+		re := regexp.MustCompile("^" + globToRegexp(tt.glob) + "$")
+		for _, s := range tt.match {
+			if !re.MatchString(s) {
+				t.Errorf("%q (%s) doesn't match %q", tt.glob, re, s)
+			}
+		}
+		for _, s := range tt.noMatch {
+			if re.MatchString(s) {
+				t.Errorf("%q (%s) matches %q", tt.glob, re, s)
+			}
+		}
+	}
+}
+
+// writeUpdignore writes lines as the .updignore of a new project root and
+// returns the patterns loaded from it
+func writeUpdignore(t *testing.T, lines ...string) (string, []ignorePattern) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, ".updignore"), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := loadIgnorePatterns(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, patterns
+}
+
+func TestIgnored(t *testing.T) {
+	_, patterns := writeUpdignore(t,
+		"# comment",
+		"",
+		"   ",
+		"vendor/",
+		"/testdata/",
+		"/top.upd",
+		"docs/*.upd",
+		"*.bak.upd",
+		"!keep.bak.upd",
+	)
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		// trailing "/" only matches directories, at any depth
+		{"vendor", true, true},
+		{"a/b/vendor", true, true},
+		{"vendor", false, false},
+
+		// leading "/" anchors to the project root
+		{"testdata", true, true},
+		{"a/testdata", true, false},
+		{"top.upd", false, true},
+		{"a/top.upd", false, false},
+
+		// a "/" in the middle anchors too
+		{"docs/x.upd", false, true},
+		{"a/docs/x.upd", false, false},
+		{"docs/a/x.upd", false, false},
+
+		// globs without "/" match the base name at any depth
+		{"x.bak.upd", false, true},
+		{"a/b/x.bak.upd", false, true},
+		{"x.upd", false, false},
+
+		// negation brings back what an earlier pattern left out
+		{"keep.bak.upd", false, false},
+		{"a/keep.bak.upd", false, false},
+
+		{"# comment", false, false},
+	}
+	for _, tt := range tests {
+		if got := ignored(patterns, tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, isDir %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoredLastMatchWins(t *testing.T) {
+	_, patterns := writeUpdignore(t, "!x.upd", "*.upd")
+	if !ignored(patterns, "x.upd", false) {
+		t.Errorf("x.upd not ignored, though *.upd comes after !x.upd")
+	}
+}
+
+func TestLoadIgnorePatternsWithoutUpdignore(t *testing.T) {
+	patterns, err := loadIgnorePatterns(t.TempDir())
+	if err != nil || patterns != nil {
+		t.Fatalf("loadIgnorePatterns() = %v, %v, want none", patterns, err)
+	}
+}
+
+func TestFindUpdFilesSkipsIgnored(t *testing.T) {
+	root, _ := writeUpdignore(t, "node_modules/", "/third_party/", "*.bak.upd", "!keep.bak.upd")
+	for _, rel := range []string{
+		"a.upd",
+		"sub/b.upd",
+		"sub/x.bak.upd",
+		"node_modules/c.upd",
+		"sub/deep/node_modules/pkg/d.upd",
+		"third_party/e.upd",
+		"sub/third_party/f.upd",
+		"sub/keep.bak.upd",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	updPaths, err := findUpdFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range updPaths {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	slices.Sort(got)
+	want := []string{"a.upd", "sub/b.upd", "sub/keep.bak.upd", "sub/third_party/f.upd"}
+	if !slices.Equal(got, want) {
+		t.Errorf("findUpdFiles() = %v, want %v", got, want)
+	}
+}
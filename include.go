@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readUpdYAML reads the .upd file (or fragment) at path with all of its
+// 'include's merged in, see the Include field of UpdFile. stack holds the
+// files currently being included to detect cycles.
+func readUpdYAML(path string, stack []string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(stack, abs) {
+		return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+	}
+	stack = append(stack, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	includes, ok := doc["include"].([]interface{})
+	if !ok {
+		if doc["include"] != nil {
+			return nil, fmt.Errorf("%s: 'include' must be a list of paths", path)
+		}
+		return doc, nil
+	}
+
+	merged := map[string]interface{}{}
+	for _, v := range includes {
+		inc, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: 'include' must be a list of paths", path)
+		}
+		fragment, err := readUpdYAML(filepath.Join(filepath.Dir(path), filepath.FromSlash(inc)), stack)
+		if err != nil {
+			return nil, fmt.Errorf("including %s: %w", inc, err)
+		}
+		deepMerge(merged, fragment)
+	}
+	return deepMerge(merged, doc), nil
+}
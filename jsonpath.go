@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathSegment is either a key of an object or an index into an array
+type jsonPathSegment struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// parseJSONPath parses dot/bracket notation like `spec.items[0]["x.y"]`,
+// an optional leading "$" is allowed
+func parseJSONPath(p string) ([]jsonPathSegment, error) {
+	var segs []jsonPathSegment
+	rest := strings.TrimPrefix(p, "$")
+	rest = strings.TrimPrefix(rest, ".")
+	if rest == "" {
+		return nil, fmt.Errorf("empty json path %q", p)
+	}
+
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: missing ']'", p)
+			}
+			inner := rest[1:end]
+			if strings.HasPrefix(inner, `"`) || strings.HasPrefix(inner, "'") {
+				// a quoted key may contain ']' itself
+				q := inner[0]
+				closing := strings.IndexByte(rest[2:], q)
+				if closing < 0 || len(rest) < closing+4 || rest[closing+3] != ']' {
+					return nil, fmt.Errorf("json path %q: unterminated quoted key", p)
+				}
+				segs = append(segs, jsonPathSegment{Key: rest[2 : closing+2]})
+				rest = rest[closing+4:]
+			} else {
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("json path %q: invalid index %q", p, inner)
+				}
+				segs = append(segs, jsonPathSegment{Index: i, IsIndex: true})
+				rest = rest[end+1:]
+			}
+		case rest[0] == '.':
+			rest = rest[1:]
+			if rest == "" || rest[0] == '.' || rest[0] == '[' {
+				return nil, fmt.Errorf("json path %q: empty key", p)
+			}
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			segs = append(segs, jsonPathSegment{Key: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return segs, nil
+}
+
+// extractJSONPath returns the value at path p of the JSON document data,
+// re-serialized as indented JSON or, if raw and the value is a string,
+// the string itself
+func extractJSONPath(data []byte, p string, raw bool) ([]byte, error) {
+	segs, err := parseJSONPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keep numbers as written
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("parsing json: %w", err)
+	}
+
+	for _, seg := range segs {
+		if seg.IsIndex {
+			arr, ok := v.([]any)
+			if !ok || seg.Index >= len(arr) {
+				return nil, fmt.Errorf("json path %q does not resolve: no index %d", p, seg.Index)
+			}
+			v = arr[seg.Index]
+		} else {
+			obj, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("json path %q does not resolve: no key %q", p, seg.Key)
+			}
+			if v, ok = obj[seg.Key]; !ok {
+				return nil, fmt.Errorf("json path %q does not resolve: no key %q", p, seg.Key)
+			}
+		}
+	}
+
+	if s, ok := v.(string); ok && raw {
+		return []byte(s), nil
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
@@ -1,32 +1,207 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v3"
 )
 
 const UPD_LINK_URL = "https://github.com/mrvnmyr/upd"
 
+var (
+	flagConnectTimeout        = 10 * time.Second
+	flagResponseHeaderTimeout = 30 * time.Second
+	flagTimeout               = time.Duration(0)
+	flagTLSTimeout            = 10 * time.Second
+
+	flagWatch         = false
+	flagWatchInterval = 30 * time.Second
+)
+
+var (
+	flagAccept           = false
+	flagAttempts         = 3
+	flagCacheDir         = ""
+	flagCachePush        = false
+	flagChangedSince     = ""
+	flagContentAddressed = false
+	flagCompareMode      = compareBytes
+	flagDNSServer        = ""
+	flagDryRun           = false
+	flagEnv              = ""
+	flagEvictOlderThan   = time.Duration(0)
+	flagExplainCache     = false
+	flagForce            = false
+	flagJobs             = runtime.NumCPU()
+	flagMaxAge           = time.Duration(0)
+	flagMaxDownloadSize  = int64(0)
+	flagMaxFailures      = 0
+	flagNoMeta           = false
+	flagNoMkdir          = false
+	flagNoWalk           = false
+	flagOffline          = false
+	flagPrintConfig      = false
+	flagProfile          = false
+	flagRecord           = ""
+	flagRemoteCache      = ""
+	flagReplay           = ""
+	flagRequireAll       = false
+	flagRequireChecksum  = false
+	flagResolve          stringsFlag
+	flagRetryDelay       = 500 * time.Millisecond
+	flagRoot             = ""
+	flagStripBOM         = false
+	flagSummaryOnly      = false
+	flagTags             stringsFlag
+	flagTLSMinVersion    = "1.2"
+	flagTLSModernCiphers = false
+	flagVerbose          = false
+	flagVerifyWrite      = false
+)
+
+func verbosef(fmtStr string, v ...interface{}) {
+	if flagVerbose {
+		fmt.Printf(fmtStr, v...)
+	}
+}
+
+// stringsFlag is a flag.Value collecting every occurrence of a repeatable flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 // Struct for the .upd file
 type UpdFile struct {
 	UpdVersion int    `yaml:"upd.version"`
 	UpdLink    string `yaml:"upd.link"`
 	URL        string `yaml:"url"`
+
+	// Include lists YAML fragments (relative to the .upd file, may include
+	// further fragments) to share settings between .upd files. They're
+	// merged in order, later ones and finally the .upd file itself taking
+	// precedence: mappings are merged key by key, anything else (scalars,
+	// lists like 'tags') is replaced as a whole. Cycles are an error.
+	Include []string `yaml:"include"`
+
+	// Headers are sent along with the http(s) requests for URL, overriding
+	// 'defaultHeaders' of CONFIG_FILE_NAME. "${VAR}" in a value is replaced
+	// with the environment variable VAR, which must be set, e.g.
+	// {Authorization: "Bearer ${TOKEN}"}. They don't affect the cache key.
+	Headers map[string]string `yaml:"headers"`
+
+	// UnixSocket fetches URL over this unix domain socket instead of TCP,
+	// the host of URL is only used for the Host header
+	UnixSocket string `yaml:"unixSocket"`
+
+	// Sha256 pins the expected (hex) sha256 of the content, a mismatch is
+	// an error, leaves the basefile untouched and drops the cache entry
+	Sha256 string `yaml:"sha256"`
+
+	// Target overrides the basefile, relative to the directory of the .upd
+	// file. Missing parent directories are created unless -no-mkdir is given.
+	Target string `yaml:"target"`
+
+	// Directory allows the basefile to be an existing directory, in which case
+	// the content is written to the last path element of URL inside of it.
+	// Without it, a basefile that is a directory is an error.
+	Directory bool `yaml:"directory"`
+
+	// IgnoreLines (a regex) and IgnoreHeaderLines (a line count) drop volatile
+	// lines from both sides before comparing, an update still writes the full
+	// upstream content
+	IgnoreLines       string `yaml:"ignoreLines"`
+	IgnoreHeaderLines int    `yaml:"ignoreHeaderLines"`
+
+	// Tags to select the file by via -tag
+	Tags []string `yaml:"tags"`
+
+	// GoVersionConstraint (e.g. ">=1.21") skips the file unless the 'go' in
+	// PATH satisfies it
+	GoVersionConstraint string `yaml:"goVersionConstraint"`
+
+	// RangeHashes is the URL (relative to URL) of a range-hash manifest for
+	// URL, so only the changed chunks of large files are downloaded (see rangefetch.go)
+	RangeHashes string `yaml:"rangeHashes"`
+
+	// Extract names a file inside the archive (zip, tar, tar.gz or tar.bz2)
+	// at URL, e.g. "tool-1.2/bin/tool", to only write that. The archive
+	// itself is what's cached, 'sha256' is of the extracted file.
+	Extract string `yaml:"extract"`
+
+	// JSONPath (dot/bracket notation, e.g. "spec.items[0].name") only writes
+	// the value at that path of the fetched JSON document. It's written as
+	// indented JSON, or with JSONRaw as the plain string if it is one.
+	JSONPath string `yaml:"jsonPath"`
+	JSONRaw  bool   `yaml:"jsonRaw"`
+
+	// StripBOM removes a leading UTF-8 BOM off fetched text content before
+	// comparing and writing, so BOM-less basefiles don't churn
+	StripBOM bool `yaml:"stripBom"`
+
+	// AppendMode treats the basefile as an append-only log: if upstream
+	// starts with the current content only the new part is appended, else
+	// (history was rewritten) it's replaced with a warning
+	AppendMode bool `yaml:"appendMode"`
+
+	// CompareMode overrides -compare-mode for this file (see compare.go)
+	CompareMode string `yaml:"compareMode"`
+
+	// Header prepends a provenance comment to the basefile, see HeaderConfig
+	Header *HeaderConfig `yaml:"header"`
+
+	// ManualReview never applies changes automatically: the new content is
+	// written to <basefile>.new for a human to review and move into place
+	// (or to apply with -accept)
+	ManualReview bool `yaml:"manualReview"`
+
+	// AllowEmpty accepts an empty upstream body, by default that's an error
+	// and leaves the basefile untouched, as it's usually a broken upstream
+	AllowEmpty bool `yaml:"allowEmpty"`
 }
 
-// Walk upwards for .updignore, else current dir
+// Walk upwards for .updignore, else current dir, unless -root
 func findProjectRoot() (string, error) {
+	if flagRoot != "" {
+		root, err := filepath.Abs(flagRoot)
+		if err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(root); err != nil {
+			return "", err
+		} else if !info.IsDir() {
+			return "", fmt.Errorf("-root %s is not a directory", flagRoot)
+		}
+		return root, nil
+	}
+
 	curDir, err := os.Getwd()
 	if err != nil {
 		return "", err
@@ -46,156 +221,1018 @@ func findProjectRoot() (string, error) {
 	}
 }
 
-// fetchWithCache caches URLs by sha256(url).ext, respects ETag/Last-Modified if possible
-func fetchWithCache(cacheDir, url string) (string, bool, error) {
-	hash := sha256.Sum256([]byte(url))
-	ext := filepath.Ext(url)
-	if ext == "" || len(ext) > 8 {
-		ext = ".dat"
+// resolveDirectoryBasefile handles a basefile that is an existing directory:
+// an error unless upd.Directory is set, else the file inside of it that is
+// named after the last path element of upd.Extract or else upd.URL
+func resolveDirectoryBasefile(basefile string, upd UpdFile) (string, error) {
+	info, err := os.Stat(basefile)
+	if err != nil || !info.IsDir() {
+		return basefile, nil // not a directory, nothing to resolve
+	}
+	if !upd.Directory {
+		return "", fmt.Errorf("target %s is a directory (set 'directory: true' to write into it)", basefile)
 	}
-	cachePath := filepath.Join(cacheDir, hex.EncodeToString(hash[:])+ext)
-	metaPath := cachePath + ".meta"
 
-	// If cache exists, try conditional GET
-	var etag, lastmod string
-	if meta, err := os.ReadFile(metaPath); err == nil {
-		lines := strings.Split(string(meta), "\n")
-		for _, l := range lines {
-			if strings.HasPrefix(l, "ETag: ") {
-				etag = strings.TrimPrefix(l, "ETag: ")
-			}
-			if strings.HasPrefix(l, "Last-Modified: ") {
-				lastmod = strings.TrimPrefix(l, "Last-Modified: ")
+	if upd.Extract != "" {
+		return filepath.Join(basefile, path.Base(cleanMemberName(upd.Extract))), nil
+	}
+	u, err := url.Parse(upd.URL)
+	if err != nil {
+		return "", fmt.Errorf("parsing url %s: %w", upd.URL, err)
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", fmt.Errorf("target %s is a directory and no filename can be derived from %s", basefile, upd.URL)
+	}
+	return filepath.Join(basefile, name), nil
+}
+
+// Reads/parses and validates a .upd file
+func loadUpdFile(updPath string) (UpdFile, error) {
+	var upd UpdFile
+	updData, err := os.ReadFile(updPath)
+	if err != nil {
+		return upd, fmt.Errorf("reading .upd file: %w", err)
+	}
+	if err := yaml.Unmarshal(updData, &upd); err != nil {
+		return upd, fmt.Errorf("parsing .upd file: %w", err)
+	}
+	if len(upd.Include) > 0 {
+		merged, err := readUpdYAML(updPath, nil)
+		if err != nil {
+			return upd, err
+		}
+		if updData, err = yaml.Marshal(merged); err != nil {
+			return upd, err
+		}
+		upd = UpdFile{}
+		if err := yaml.Unmarshal(updData, &upd); err != nil {
+			return upd, fmt.Errorf("parsing .upd file with its includes: %w", err)
+		}
+	}
+	if upd.UpdVersion == 0 {
+		return upd, errors.New("every .upd file must set a non-zero 'upd.version' field")
+	}
+	if upd.UpdLink != UPD_LINK_URL {
+		return upd, errors.New("every .upd file must set 'upd.link' to: " + UPD_LINK_URL)
+	}
+	if upd.URL == "" {
+		return upd, errors.New("no url field in .upd file")
+	}
+	if upd.URL, err = resolveURL(upd.URL); err != nil {
+		return upd, fmt.Errorf("resolving url: %w", err)
+	}
+	if upd.RangeHashes != "" {
+		// relative to url, so it can simply be "<file>.json"
+		base, err := url.Parse(upd.URL)
+		if err != nil {
+			return upd, fmt.Errorf("parsing url: %w", err)
+		}
+		ref, err := url.Parse(upd.RangeHashes)
+		if err != nil {
+			return upd, fmt.Errorf("parsing rangeHashes: %w", err)
+		}
+		upd.RangeHashes = base.ResolveReference(ref).String()
+	}
+	if upd.IgnoreHeaderLines < 0 {
+		return upd, errors.New("'ignoreHeaderLines' must not be negative")
+	}
+	if upd.CompareMode != "" {
+		if err := validCompareMode(upd.CompareMode); err != nil {
+			return upd, fmt.Errorf("parsing 'compareMode': %w", err)
+		}
+	}
+	if upd.JSONPath != "" {
+		if _, err := parseJSONPath(upd.JSONPath); err != nil {
+			return upd, fmt.Errorf("parsing 'jsonPath': %w", err)
+		}
+	} else if upd.JSONRaw {
+		return upd, errors.New("'jsonRaw' requires 'jsonPath'")
+	}
+	if upd.Header != nil && upd.AppendMode {
+		return upd, errors.New("'header' can't be combined with 'appendMode'")
+	}
+	return upd, nil
+}
+
+var envRefRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces every "${VAR}" in s with the value of the environment
+// variable VAR, failing if one isn't set
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envRefRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefRegex.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// fetchRequestFor returns the FetchRequest to fetch the content of upd with,
+// failing if its 'headers' or the 'defaultHeaders' refer to environment
+// variables that aren't set. Header names are canonicalized, the defaults
+// first, so 'headers' override them whatever their case.
+func fetchRequestFor(cacheDir string, upd UpdFile) (FetchRequest, error) {
+	headers := map[string]string{}
+	for _, templates := range []map[string]string{config.DefaultHeaders, upd.Headers} {
+		for _, name := range slices.Sorted(maps.Keys(templates)) {
+			value, err := expandEnv(templates[name])
+			if err != nil {
+				return FetchRequest{}, fmt.Errorf("header %s: %w", name, err)
 			}
+			headers[http.CanonicalHeaderKey(name)] = value
 		}
 	}
+	return FetchRequest{
+		CacheDir:   cacheDir,
+		URL:        upd.URL,
+		UnixSocket: upd.UnixSocket,
+		Headers:    headers,
 
-	client := &http.Client{Timeout: 15 * time.Second}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", false, err
+		RangeHashes: upd.RangeHashes,
+	}, nil
+}
+
+// Figure out basefile (strip last .upd from filename, unless overridden by target)
+func basefileFor(updPath string, upd UpdFile) (string, error) {
+	basefile := strings.TrimSuffix(updPath, ".upd")
+	if upd.Target != "" {
+		basefile = filepath.Join(filepath.Dir(updPath), filepath.FromSlash(upd.Target))
 	}
-	if etag != "" {
-		req.Header.Set("If-None-Match", etag)
+	return resolveDirectoryBasefile(basefile, upd)
+}
+
+// ensureParentDir creates the missing parent directories of path, or with
+// -no-mkdir reports them as an error
+func ensureParentDir(path string) error {
+	dir := filepath.Dir(path)
+	if flagNoMkdir {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("parent directory %s of %s does not exist (not creating it due to -no-mkdir)", dir, path)
+		}
+		return nil
 	}
-	if lastmod != "" {
-		req.Header.Set("If-Modified-Since", lastmod)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating parent directory of %s: %w", path, err)
 	}
+	return nil
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		// If we can't reach the server, use cache if available
-		if _, statErr := os.Stat(cachePath); statErr == nil {
-			return cachePath, true, nil
+// stripIgnoredLines drops the first upd.IgnoreHeaderLines lines and all lines
+// matching ignoreRe (if non-nil) from content
+func stripIgnoredLines(content []byte, upd UpdFile, ignoreRe *regexp.Regexp) []byte {
+	lines := strings.SplitAfter(string(content), "\n")
+	if upd.IgnoreHeaderLines >= len(lines) {
+		return nil
+	}
+	lines = lines[upd.IgnoreHeaderLines:]
+
+	var out []byte
+	for _, l := range lines {
+		if ignoreRe != nil && ignoreRe.MatchString(strings.TrimRight(l, "\r\n")) {
+			continue
 		}
-		return "", false, err
+		out = append(out, l...)
 	}
-	defer resp.Body.Close()
+	return out
+}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		out, err := os.Create(cachePath)
-		if err != nil {
-			return "", false, err
+// matchesTagFilter reports whether a file with tags is selected by the -tag
+// filters: it must have none of the excluding '!tag' ones and, if it has any
+// tags and including filters are given, at least one of those. So files
+// without tags are always selected, there's nothing for a filter to match.
+func matchesTagFilter(tags, filters []string) bool {
+	hasTag := func(t string) bool {
+		for _, tag := range tags {
+			if tag == t {
+				return true
+			}
 		}
-		_, err = io.Copy(out, resp.Body)
-		out.Close()
-		if err != nil {
-			return "", false, err
+		return false
+	}
+
+	included, haveIncludes := false, false
+	for _, f := range filters {
+		if exclude, ok := strings.CutPrefix(f, "!"); ok {
+			if hasTag(exclude) {
+				return false
+			}
+			continue
+		}
+		haveIncludes = true
+		if hasTag(f) {
+			included = true
 		}
-		etag := resp.Header.Get("ETag")
-		lastmod := resp.Header.Get("Last-Modified")
-		meta := fmt.Sprintf("ETag: %s\nLast-Modified: %s\n", etag, lastmod)
-		_ = os.WriteFile(metaPath, []byte(meta), 0o644)
-		return cachePath, false, nil
-	case http.StatusNotModified:
-		// Use cache
-		return cachePath, true, nil
-	default:
-		return "", false, fmt.Errorf("http error: %s", resp.Status)
 	}
+	return included || !haveIncludes || len(tags) == 0
 }
 
-// Reads/parses .upd, fetches and caches content, compares with basefile, updates if changed
-func updateFile(projectRoot, updPath string) error {
-	updData, err := os.ReadFile(updPath)
+// stripUTF8BOM returns content without its leading UTF-8 BOM, if it has one
+// and is text. Binary content that happens to start with EF BB BF is kept.
+func stripUTF8BOM(content []byte) ([]byte, bool) {
+	rest, ok := bytes.CutPrefix(content, []byte{0xEF, 0xBB, 0xBF})
+	if !ok || !utf8.Valid(rest) {
+		return content, false
+	}
+	return rest, true
+}
+
+// verifyWritten re-reads path and checks it holds exactly content
+func verifyWritten(path string, content []byte) error {
+	written, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("reading .upd file: %w", err)
+		return fmt.Errorf("verifying %s: %w", path, err)
 	}
-	var upd UpdFile
-	if err := yaml.Unmarshal(updData, &upd); err != nil {
-		return fmt.Errorf("parsing .upd file: %w", err)
+	expected := sha256.Sum256(content)
+	actual := sha256.Sum256(written)
+	if expected != actual {
+		return fmt.Errorf("verifying %s: expected sha256 %x, found %x on disk", path, expected, actual)
 	}
-	if upd.UpdVersion == 0 {
-		return errors.New("every .upd file must set a non-zero 'upd.version' field")
+	return nil
+}
+
+// updateOutcome is what updateFile did with a .upd file
+type updateOutcome int
+
+const (
+	outcomeUnchanged updateOutcome = iota
+	outcomeUpdated
+	outcomeSkipped
+)
+
+// reportf prints progress output such as per-file lines to w, unless
+// -summary-only
+func reportf(w io.Writer, format string, args ...any) {
+	if !flagSummaryOnly {
+		fmt.Fprintf(w, format, args...)
 	}
-	if upd.UpdLink != UPD_LINK_URL {
-		return errors.New("every .upd file must set 'upd.link' to: " + UPD_LINK_URL)
+}
+
+// reportUnchangedf is reportf for files that are left as they are, which
+// -watch doesn't print
+func reportUnchangedf(w io.Writer, format string, args ...any) {
+	if !flagWatch {
+		reportf(w, format, args...)
 	}
-	if upd.URL == "" {
-		return errors.New("no url field in .upd file")
+}
+
+// fileOutput buffers what is printed while processing a single .upd file, so
+// files processed concurrently (see -j) are still reported one after another
+type fileOutput struct {
+	stdout, stderr bytes.Buffer
+}
+
+func (o *fileOutput) flush() {
+	os.Stdout.Write(o.stdout.Bytes())
+	os.Stderr.Write(o.stderr.Bytes())
+}
+
+// Fetches and caches content of a .upd file, compares with basefile, updates if changed
+func updateFile(projectRoot, updPath string, out *fileOutput) (updateOutcome, error) {
+	upd, err := loadUpdFile(updPath)
+	if err != nil {
+		return outcomeUnchanged, err
+	}
+	basefile, err := basefileFor(updPath, upd)
+	if err != nil {
+		return outcomeUnchanged, err
+	}
+	if !matchesTagFilter(upd.Tags, flagTags) {
+		reportUnchangedf(&out.stdout, "%s skipped, not selected by -tag %s\n", basefile, flagTags.String())
+		return outcomeSkipped, nil
+	}
+	if upd.GoVersionConstraint != "" {
+		version, err := currentGoVersion()
+		if err != nil {
+			return outcomeUnchanged, err
+		}
+		ok, err := satisfiesVersionConstraint(version, upd.GoVersionConstraint)
+		if err != nil {
+			return outcomeUnchanged, fmt.Errorf("parsing 'goVersionConstraint': %w", err)
+		}
+		if !ok {
+			reportUnchangedf(&out.stdout, "%s skipped, requires go %s (have %s)\n", basefile, upd.GoVersionConstraint, version)
+			return outcomeSkipped, nil
+		}
+	}
+	var ignoreRe *regexp.Regexp
+	if upd.IgnoreLines != "" {
+		if ignoreRe, err = regexp.Compile(upd.IgnoreLines); err != nil {
+			return outcomeUnchanged, fmt.Errorf("parsing 'ignoreLines': %w", err)
+		}
 	}
 
-	// determine cacheDir
-	home, err := os.UserHomeDir()
+	cacheDir, err := defaultCacheDir()
 	if err != nil {
-		return fmt.Errorf("could not determine home directory: %w", err)
+		return outcomeUnchanged, err
 	}
-	cacheDir := filepath.Join(home, ".cache", "upd", "urlcache")
 
-	os.MkdirAll(cacheDir, 0o755)
-	cachePath, cacheHit, err := fetchWithCache(cacheDir, upd.URL)
+	var timings phaseTimings
+	fr, err := fetchRequestFor(cacheDir, upd)
 	if err != nil {
-		return fmt.Errorf("fetching %s: %w", upd.URL, err)
+		return outcomeUnchanged, err
+	}
+	fr.RangeSeed = basefile
+	if flagProfile {
+		fr.Timings = &timings
+		defer func() { recordProfile(basefile, timings) }()
 	}
 
-	// Figure out basefile (strip last .upd from filename)
-	basefile := strings.TrimSuffix(updPath, ".upd")
+	os.MkdirAll(cacheDir, 0o755) // copes with other -j workers creating it at the same time
+	fetched, err := fetchURL(fr)
+	var tooLarge *downloadTooLargeError
+	if errors.As(err, &tooLarge) {
+		recordSkippedDownload(tooLarge)
+		reportf(&out.stdout, "%s skipped, %v\n", basefile, tooLarge)
+		return outcomeSkipped, nil
+	}
+	if err != nil {
+		return outcomeUnchanged, fmt.Errorf("fetching %s: %w", upd.URL, err)
+	}
+	if flagExplainCache {
+		fmt.Fprintf(&out.stdout, "%s: %s\n", basefile, fetched.Reason)
+	}
 
 	// Compare
-	urlContent, err := os.ReadFile(cachePath)
+	urlContent, err := os.ReadFile(fetched.Path)
+	if err != nil {
+		return outcomeUnchanged, fmt.Errorf("reading cache: %w", err)
+	}
+	if len(urlContent) == 0 && !upd.AllowEmpty {
+		return outcomeUnchanged, fmt.Errorf("%s returned an empty body, keeping %s (set 'allowEmpty: true' if that's expected)", upd.URL, basefile)
+	}
+	urlContent, err = transformContent(upd, basefile, urlContent)
+	if errors.Is(err, errSha256Mismatch) {
+		invalidateCacheEntry(cachePathFor(cacheDir, fr.cacheKey()))
+		fetchMemo.Delete(fr.memoKey())
+	}
+	if err != nil {
+		return outcomeUnchanged, err
+	}
+	mode := compareModeFor(upd)
+	compareStart := time.Now()
+	result, err := compareContent(mode, urlContent, basefile, upd, ignoreRe)
+	timings.Compare = time.Since(compareStart)
 	if err != nil {
-		return fmt.Errorf("reading cache: %w", err)
+		return outcomeUnchanged, err
 	}
-	baseContent, _ := os.ReadFile(basefile) // ignore error, treat as empty if not exists
 
-	if string(urlContent) == string(baseContent) {
-		fmt.Printf("%s already up to date (cache hit: %v)\n", basefile, cacheHit)
-		return nil
+	switch result {
+	case contentEqual:
+		if upd.ManualReview && !flagDryRun {
+			os.Remove(basefile + ".new") // reviewed and moved into place already
+		}
+		reportUnchangedf(&out.stdout, "%s already up to date (cache hit: %v)\n", basefile, fetched.CacheHit)
+		return outcomeUnchanged, nil
+	case contentEquivalent:
+		if mode == compareSemantic {
+			reportUnchangedf(&out.stdout, "%s only differs in line endings or ignored lines, not updating\n", basefile)
+		} else {
+			reportUnchangedf(&out.stdout, "%s only differs in ignored lines, not updating\n", basefile)
+		}
+		return outcomeUnchanged, nil
 	}
 
-	// Update
-	if err := os.WriteFile(basefile, urlContent, 0o644); err != nil {
-		return fmt.Errorf("updating %s: %w", basefile, err)
+	writeStart := time.Now()
+	defer func() { timings.Write = time.Since(writeStart) }()
+	return writeBasefile(upd, basefile, urlContent, withHeader(upd, basefile, urlContent), out)
+}
+
+// writeBasefile puts written, which is content plus the 'header', into the
+// basefile of upd: only reporting it with -dry-run, to <basefile>.new with
+// 'manualReview', else appending or replacing it and with -verify-write
+// making sure it arrived
+func writeBasefile(upd UpdFile, basefile string, content, written []byte, out *fileOutput) (updateOutcome, error) {
+	if flagDryRun {
+		if err := checkExtensionAllowed(basefile); err != nil {
+			return outcomeUnchanged, err
+		}
+		reportf(&out.stdout, "Would update %s\n", basefile)
+		return outcomeUpdated, nil
 	}
-	fmt.Printf("Updated %s\n", basefile)
-	return nil
+	if upd.ManualReview && !flagAccept {
+		return writeForReview(basefile, written, out)
+	}
+
+	var baseContent []byte
+	var baseErr error = fs.ErrNotExist
+	if flagVerifyWrite || upd.AppendMode {
+		baseContent, baseErr = os.ReadFile(basefile) // to restore it if verifying fails
+	}
+
+	if err := checkExtensionAllowed(basefile); err != nil {
+		return outcomeUnchanged, err
+	}
+	if err := ensureParentDir(basefile); err != nil {
+		return outcomeUnchanged, err
+	}
+	appended := false
+	if upd.AppendMode && baseErr == nil {
+		if delta, ok := bytes.CutPrefix(content, baseContent); ok {
+			if err := appendToFile(basefile, delta); err != nil {
+				return outcomeUnchanged, fmt.Errorf("appending to %s: %w", basefile, err)
+			}
+			appended = true
+		} else {
+			fmt.Fprintf(&out.stderr, "Warning: %s: upstream doesn't start with the current content anymore, replacing it\n", basefile)
+		}
+	}
+	if !appended {
+		if err := writeFileAtomic(basefile, written); err != nil {
+			return outcomeUnchanged, fmt.Errorf("updating %s: %w", basefile, err)
+		}
+	}
+	if flagVerifyWrite {
+		if err := verifyWritten(basefile, written); err != nil {
+			if baseErr == nil {
+				// best effort, put back what was there before
+				if restoreErr := writeFileAtomic(basefile, baseContent); restoreErr != nil {
+					return outcomeUnchanged, fmt.Errorf("%w (restoring previous content failed: %v)", err, restoreErr)
+				}
+			}
+			return outcomeUnchanged, err
+		}
+	}
+	if upd.ManualReview {
+		os.Remove(basefile + ".new") // superseded by -accept
+	}
+	if appended {
+		reportf(&out.stdout, "Appended %d bytes to %s\n", len(content)-len(baseContent), basefile)
+	} else {
+		reportf(&out.stdout, "Updated %s\n", basefile)
+	}
+	return outcomeUpdated, nil
 }
 
-func main() {
-	projectRoot, err := findProjectRoot()
+// errSha256Mismatch is what transformContent fails with when the fetched
+// content doesn't match the 'sha256' pin
+var errSha256Mismatch = errors.New("sha256 mismatch")
+
+// transformContent turns the fetched body of upd into what its basefile is
+// compared against: the 'extract'ed member, checked against 'sha256',
+// without a UTF-8 BOM and narrowed down to 'jsonPath'
+func transformContent(upd UpdFile, basefile string, content []byte) ([]byte, error) {
+	var err error
+	if upd.Extract != "" {
+		if content, err = extractMember(content, upd.Extract); err != nil {
+			return nil, fmt.Errorf("%s: %w", upd.URL, err)
+		}
+	}
+	if upd.Sha256 != "" {
+		sum := sha256.Sum256(content)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, upd.Sha256) {
+			return nil, fmt.Errorf("%w: expected %s, got %s", errSha256Mismatch, upd.Sha256, actual)
+		}
+	}
+	if stripsBOM(upd) {
+		if stripped, ok := stripUTF8BOM(content); ok {
+			verbosef("%s: stripped UTF-8 BOM\n", basefile)
+			content = stripped
+		}
+	}
+	if upd.JSONPath != "" {
+		if content, err = extractJSONPath(content, upd.JSONPath, upd.JSONRaw); err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+// stripsBOM tells whether a UTF-8 BOM is stripped off the content of upd,
+// via 'stripBom' or -strip-bom
+func stripsBOM(upd UpdFile) bool {
+	return upd.StripBOM || flagStripBOM
+}
+
+// withHeader returns content as written to the basefile, prefixed with the
+// 'header' unless it's binary
+func withHeader(upd UpdFile, basefile string, content []byte) []byte {
+	if upd.Header == nil {
+		return content
+	}
+	if isBinary(content) {
+		verbosef("%s: binary content, not adding a header\n", basefile)
+		return content
+	}
+	return append(upd.Header.render(upd.URL, time.Now()), content...)
+}
+
+// writeForReview writes the new content of the 'manualReview' basefile to
+// <basefile>.new instead, leaving the basefile itself untouched
+func writeForReview(basefile string, content []byte, out *fileOutput) (updateOutcome, error) {
+	newPath := basefile + ".new"
+	if pending, err := os.ReadFile(newPath); err == nil && bytes.Equal(pending, content) {
+		reportUnchangedf(&out.stdout, "%s still awaits review of %s\n", basefile, newPath)
+		return outcomeSkipped, nil
+	}
+	if err := checkExtensionAllowed(basefile); err != nil {
+		return outcomeUnchanged, err
+	}
+	if err := ensureParentDir(basefile); err != nil {
+		return outcomeUnchanged, err
+	}
+	if err := os.WriteFile(newPath, content, 0o644); err != nil {
+		return outcomeUnchanged, fmt.Errorf("writing %s: %w", newPath, err)
+	}
+	reportf(&out.stdout, "%s changed upstream and requires manual review: wrote %s (move it into place or run with -accept)\n", basefile, newPath)
+	return outcomeSkipped, nil
+}
+
+// writeFileAtomic replaces the content of the file at path with data by
+// writing a temporary file next to it and renaming that over it, so nobody
+// ever sees it half written. An existing file keeps its permissions (e.g. the
+// executable bit of scripts), a new one gets 0o644 minus the umask. If path is
+// a symlink, its target is replaced.
+func writeFileAtomic(path string, data []byte) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	var keepMode *os.FileMode
+	if info, err := os.Stat(path); err == nil {
+		mode := info.Mode().Perm()
+		keepMode = &mode
+	}
+
+	// same directory, so the rename doesn't cross file systems
+	tmp, err := createTempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-", 0o644)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error finding project root: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && keepMode != nil {
+		err = os.Chmod(tmp.Name(), *keepMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// createTempFile is os.CreateTemp with the permissions of a file created by
+// os.WriteFile, so the umask applies to perm instead of a fixed 0o600
+func createTempFile(dir, prefix string, perm os.FileMode) (*os.File, error) {
+	for range 10000 {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("creating a temporary file in %s: too many attempts", dir)
+}
+
+// appendToFile appends data to the existing file at path
+func appendToFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// processUpdFiles runs updateFile for all updPaths and counts the outcomes
+func processUpdFiles(projectRoot string, updPaths []string) (summary runSummary, err error) {
+	maxFailures, reason := flagMaxFailures, "-max-failures"
+	if flagRequireAll {
+		maxFailures, reason = 1, "-require-all"
+	}
+
+	// a failing file doesn't keep the others from being updated, unless
+	// -require-all or -max-failures. Note that a file only fails once its fetch really
+	// failed: if upstream is unreachable but the file is cached, the cached
+	// body is used and that's not a failure.
+	//
+	// Up to -j files are processed at once, their output is buffered and
+	// printed in the order of updPaths. Once too many failed no further
+	// files are started, those already running still finish.
+	type result struct {
+		out     fileOutput
+		outcome updateOutcome
+		err     error
+		skipped bool // not processed because of maxFailures
+		done    chan struct{}
+	}
+	results := make([]result, len(updPaths))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+
+	var failedCount atomic.Int64
+	var aborted atomic.Bool
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range updPaths {
+			if aborted.Load() {
+				results[i].skipped = true
+				close(results[i].done)
+				continue
+			}
+			jobs <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range max(1, min(flagJobs, len(updPaths))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &results[i]
+				if aborted.Load() {
+					r.skipped = true
+				} else {
+					r.outcome, r.err = updateFile(projectRoot, updPaths[i], &r.out)
+					if r.err != nil && maxFailures > 0 && failedCount.Add(1) >= int64(maxFailures) {
+						aborted.Store(true)
+					}
+				}
+				close(r.done)
+			}
+		}()
+	}
+
+	notProcessed := 0
+	for i := range results {
+		r := &results[i]
+		<-r.done
+		if r.skipped {
+			notProcessed++
+			continue
+		}
+		r.out.flush()
+		switch {
+		case r.err != nil:
+			if !flagSummaryOnly { // printSummary lists it along with the tally
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", updPaths[i], r.err)
+			}
+			summary.Failures = append(summary.Failures, fileFailure{updPaths[i], r.err})
+		case r.outcome == outcomeUpdated:
+			summary.Updated = append(summary.Updated, updPaths[i])
+		case r.outcome == outcomeUnchanged:
+			summary.Unchanged = append(summary.Unchanged, updPaths[i])
+		}
+	}
+	wg.Wait()
+	if aborted.Load() {
+		err = fmt.Errorf("aborting because of %s after %d failed file(s), %d file(s) not processed", reason, len(summary.Failures), notProcessed)
+	}
+	return summary, err
+}
+
+// runSummary is what processUpdFiles did with the .upd files, by their paths
+type runSummary struct {
+	Updated   []string
+	Unchanged []string
+	Failures  []fileFailure
+}
+
+// fileFailure is a .upd file processUpdFiles failed on
+type fileFailure struct {
+	UpdPath string
+	Err     error
+}
+
+// printSummary prints the tally of a run followed by which files were
+// updated, unchanged and failed, the failures with their errors on stderr.
+// -summary-only leaves out the updated and unchanged files.
+func printSummary(summary runSummary) {
+	updatedTitle := "Updated"
+	verb := "updated"
+	if flagDryRun {
+		updatedTitle, verb = "Out of date", "out of date"
 	}
+	fmt.Printf("%d %s, %d unchanged, %d failed\n", len(summary.Updated), verb, len(summary.Unchanged), len(summary.Failures))
+	if !flagSummaryOnly {
+		for _, group := range []struct {
+			title    string
+			updPaths []string
+		}{{updatedTitle, summary.Updated}, {"Unchanged", summary.Unchanged}} {
+			if len(group.updPaths) == 0 {
+				continue
+			}
+			fmt.Printf("%s:\n", group.title)
+			for _, updPath := range group.updPaths {
+				fmt.Printf("  %s\n", updPath)
+			}
+		}
+	}
+	if len(summary.Failures) > 0 {
+		fmt.Fprintf(os.Stderr, "Failed:\n")
+		for _, f := range summary.Failures {
+			fmt.Fprintf(os.Stderr, "  %s: %v\n", f.UpdPath, f.Err)
+		}
+	}
+}
 
-	fmt.Printf("Project root: %s\n", projectRoot)
+// findUnpinned returns those of updPaths selected by -tag without a 'sha256',
+// files that can't be loaded are left to fail when processed
+func findUnpinned(updPaths []string) []string {
+	var unpinned []string
+	for _, updPath := range updPaths {
+		upd, err := loadUpdFile(updPath)
+		if err == nil && upd.Sha256 == "" && matchesTagFilter(upd.Tags, flagTags) {
+			unpinned = append(unpinned, updPath)
+		}
+	}
+	return unpinned
+}
 
+// findUpdFiles returns the absolute paths of all .upd files below projectRoot,
+// leaving out what its .updignore matches
+func findUpdFiles(projectRoot string) ([]string, error) {
+	patterns, err := loadIgnorePatterns(projectRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var updPaths []string
 	err = filepath.WalkDir(projectRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+		if rel, err := filepath.Rel(projectRoot, path); err == nil && rel != "." && ignored(patterns, filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if !d.IsDir() && strings.HasSuffix(d.Name(), ".upd") {
 			absPath, err := filepath.Abs(path)
 			if err != nil {
 				return err
 			}
-			return updateFile(projectRoot, absPath)
+			updPaths = append(updPaths, absPath)
 		}
 		return nil
 	})
+	return updPaths, err
+}
+
+func parseCLIFlags() {
+	flag.DurationVar(&flagConnectTimeout, "connect-timeout", flagConnectTimeout, "Timeout for establishing a connection")
+	flag.DurationVar(&flagTLSTimeout, "tls-timeout", flagTLSTimeout, "Timeout for the TLS handshake")
+	flag.DurationVar(&flagResponseHeaderTimeout, "response-header-timeout", flagResponseHeaderTimeout, "Timeout for receiving the response headers after sending a request")
+	flag.DurationVar(&flagTimeout, "timeout", flagTimeout, "Overall timeout per request including reading the body, 0 disables it")
+	flag.IntVar(&flagAttempts, "attempts", flagAttempts, "How often to try a request failing with a connection error, timeout, 429 or 5xx before giving up")
+	flag.DurationVar(&flagRetryDelay, "retry-delay", flagRetryDelay, "How long to wait before the first retry, doubling with each further one (unless the server sends Retry-After)")
+
+	flag.BoolVar(&flagWatch, "watch", false, "Keep running, syncing again every -interval or when a .upd file changes")
+	flag.DurationVar(&flagWatchInterval, "interval", flagWatchInterval, "How often -watch syncs, backing off while files fail")
+
+	flag.BoolVar(&flagAccept, "accept", false, "Apply changes of 'manualReview' files instead of writing them to <basefile>.new")
+	flag.StringVar(&flagCacheDir, "cache-dir", "", "Cache fetched bodies here instead of ~/.cache/upd/urlcache")
+	flag.BoolVar(&flagCachePush, "cache-push", false, "Upload freshly fetched bodies to the -remote-cache")
+	flag.StringVar(&flagChangedSince, "changed-since", "", "Only process the .upd files that (or whose basefiles) changed between this git ref and HEAD, e.g. origin/main")
+	flag.BoolVar(&flagContentAddressed, "cas", false, "Store fetched bodies in the cache by their sha256, deduplicating identical bodies of different URLs")
+	flag.BoolVar(&flagContentAddressed, "content-addressed", false, "Store fetched bodies in the cache by their sha256 (same as -cas)")
+	flag.StringVar(&flagCompareMode, "compare-mode", flagCompareMode, "How to tell whether a basefile is up to date: bytes, hash (streamed sha256, for large files) or semantic (also ignoring line endings)")
+	flag.BoolVar(&flagDryRun, "n", false, "Fetch and compare, but only print what would be updated, exiting 1 if anything is out of date")
+	flag.BoolVar(&flagDryRun, "dry-run", false, "Fetch and compare, but only print what would be updated (same as -n)")
+	flag.StringVar(&flagDNSServer, "dns-server", "", "Nameserver (ip[:port]) to retry resolving with when the system resolver fails")
+	flag.StringVar(&flagEnv, "env", "", "Overlay "+CONFIG_FILE_NAME+" with "+CONFIG_FILE_NAME+".<env> (default: $UPD_ENV)")
+	flag.DurationVar(&flagEvictOlderThan, "evict-older-than", 0, "After the run, delete cache entries last fetched longer ago than this (e.g. 720h) and not used by the run, 0 disables it")
+	flag.BoolVar(&flagForce, "f", false, "Always fetch the full body, without conditional requests against the cache")
+	flag.BoolVar(&flagForce, "force", false, "Always fetch the full body, without conditional requests against the cache (same as -f)")
+	flag.BoolVar(&flagExplainCache, "explain-cache", false, "Print for every file how the cache was used and why, e.g. a 304 serving the cached body")
+	flag.Int64Var(&flagMaxDownloadSize, "max-download-size", 0, "Skip (leaving the basefile as is) files whose download would be larger than this many bytes, 0 disables it")
+	flag.IntVar(&flagJobs, "j", flagJobs, "How many .upd files to process at once")
+	flag.IntVar(&flagJobs, "jobs", flagJobs, "How many .upd files to process at once (same as -j)")
+	flag.DurationVar(&flagMaxAge, "max-age", 0, "Use cached bodies last fetched less than this long ago without asking upstream, 0 always asks")
+	flag.IntVar(&flagMaxFailures, "max-failures", 0, "Stop processing further files once this many failed, 0 means never")
+	flag.BoolVar(&flagNoMeta, "no-meta", false, "Debug caching: act as if no cache .meta files existed, doing plain GETs and not writing any (bodies are still cached)")
+	flag.BoolVar(&flagNoMkdir, "no-mkdir", false, "Fail instead of creating missing parent directories of basefiles")
+	flag.BoolVar(&flagNoWalk, "no-walk", false, "Don't search the project root for .upd files, require them as arguments")
+	flag.BoolVar(&flagOffline, "offline", false, "Only use the cache, never the network, failing for anything that was never fetched")
+	flag.BoolVar(&flagPrintConfig, "print-config", false, "Print the effective configuration, including every .upd file as resolved, as YAML and exit")
+	flag.BoolVar(&flagProfile, "profile", false, "Print how long each file spent in DNS, connect, TLS, first byte, download, compare and write")
+	flag.StringVar(&flagRecord, "record", "", "Save every HTTP response into this directory, for -replay")
+	flag.StringVar(&flagRemoteCache, "remote-cache", "", "Base URL of a shared cache to try before going upstream on a local cache miss")
+	flag.StringVar(&flagReplay, "replay", "", "Answer HTTP requests from a directory written by -record instead of the network")
+	flag.BoolVar(&flagRequireAll, "require-all", false, "Abort the run on the first .upd file that fails instead of continuing with the others")
+	flag.BoolVar(&flagRequireChecksum, "require-checksum", false, "Refuse to run, before fetching anything, if any .upd file has no 'sha256'")
+	flag.StringVar(&flagRoot, "root", "", "Use this directory as the project root instead of searching upwards for a .updignore")
+	flag.Var(&flagResolve, "resolve", "Connect to ip instead of resolving host, as host:ip (repeatable)")
+	flag.BoolVar(&flagStripBOM, "strip-bom", false, "Strip a leading UTF-8 BOM off all fetched text content (same as 'stripBom: true' everywhere)")
+	flag.BoolVar(&flagSummaryOnly, "summary-only", false, "Only print the final 'N updated, M unchanged, K failed' tally and errors")
+	flag.Var(&flagTags, "tag", "Only process .upd files tagged so, '!tag' excludes files tagged so (repeatable, a tagged file must match any including and no excluding -tag, untagged files are always processed)")
+	flag.StringVar(&flagTLSMinVersion, "tls-min-version", flagTLSMinVersion, "Minimum TLS version to accept: 1.2 or 1.3")
+	flag.BoolVar(&flagTLSModernCiphers, "tls-modern-ciphers", false, "Only accept ECDHE key exchange with AEAD ciphers (AES-GCM, ChaCha20-Poly1305) for TLS 1.2, TLS 1.3 ones are modern anyway")
+	flag.BoolVar(&flagVerbose, "v", false, "Enable verbose output")
+	flag.BoolVar(&flagVerbose, "verbose", false, "Enable verbose output (same as -v)")
+	flag.BoolVar(&flagVerifyWrite, "vw", false, "Re-read every written file and check its sha256")
+	flag.BoolVar(&flagVerifyWrite, "verify-write", false, "Re-read every written file and check its sha256 (same as -vw)")
+
+	flag.Usage = func() {
+		fmt.Printf("To update all .upd files below the project root,\nrun this program without arguments.\n")
+		fmt.Printf("To only update some, pass them as arguments: upd [flags] <file.upd>...\n\n")
+		fmt.Printf("Commands:\n")
+		fmt.Printf("  export <bundle.tar.gz>  Bundle the content of all .upd files for offline transfer\n")
+		fmt.Printf("  import <bundle.tar.gz>  Write basefiles and seed the cache from a bundle\n")
+		fmt.Printf("  audit [-strict]         List all sources with their scheme and checksum pin status\n")
+		fmt.Printf("  fix [-dry-run]          Repair the cache and remove orphaned .new/.bak files left by interrupted runs\n")
+		fmt.Printf("  ignore init [-force]    Create a starter .updignore in the current directory\n")
+		fmt.Printf("  pin [-dry-run]          Write the sha256 of the current upstream content into every .upd file\n")
+		fmt.Printf("  refresh-check           Tell whether upstream changed since it was cached, touching nothing\n")
+		fmt.Printf("  verify -offline         Check every basefile against its pinned sha256, without network\n\n")
+		flag.PrintDefaults()
+	}
+
+	// Parse flags
+	flag.Parse()
+
+	if err := parseResolveOverrides(flagResolve); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	if flagAttempts < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -attempts %d, expected at least 1\n", flagAttempts)
+		os.Exit(2)
+	}
+	if flagJobs < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -j %d, expected at least 1\n", flagJobs)
+		os.Exit(2)
+	}
+	if _, ok := tlsVersions[flagTLSMinVersion]; !ok {
+		fmt.Fprintf(os.Stderr, "Invalid -tls-min-version %q, expected 1.2 or 1.3\n", flagTLSMinVersion)
+		os.Exit(2)
+	}
+	if flagDNSServer != "" {
+		server, err := parseDNSServer(flagDNSServer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		flagDNSServer = server
+	}
+	if flagOffline && flagForce {
+		fmt.Fprintf(os.Stderr, "-offline and -force are mutually exclusive\n")
+		os.Exit(2)
+	}
+	if flagDryRun && flagWatch {
+		fmt.Fprintf(os.Stderr, "-dry-run and -watch are mutually exclusive\n")
+		os.Exit(2)
+	}
+	if flagRecord != "" && flagReplay != "" {
+		fmt.Fprintf(os.Stderr, "-record and -replay are mutually exclusive\n")
+		os.Exit(2)
+	}
+	if err := validCompareMode(flagCompareMode); err != nil {
+		fmt.Fprintf(os.Stderr, "-compare-mode: %v\n", err)
+		os.Exit(2)
+	}
+	if flagWatch && flagWatchInterval < time.Second {
+		fmt.Fprintf(os.Stderr, "-interval must be at least 1s\n")
+		os.Exit(2)
+	}
+}
+
+func main() {
+	parseCLIFlags()
+
+	if flag.Arg(0) == "ignore" {
+		// creates the project root marker, so don't look for one
+		os.Exit(runIgnore(flag.Args()[1:]))
+	}
+
+	projectRoot, err := findProjectRoot()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error finding project root: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !flagPrintConfig {
+		reportf(os.Stdout, "Project root: %s\n", projectRoot)
+	}
+
+	env, explicitEnv := flagEnv, flagEnv != ""
+	if !explicitEnv {
+		env = os.Getenv("UPD_ENV")
+	}
+	if err := loadConfig(projectRoot, env, explicitEnv); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "export", "import":
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: upd %s <bundle.tar.gz>\n", flag.Arg(0))
+			os.Exit(2)
+		}
+		bundle := flag.Arg(1)
+		if flag.Arg(0) == "export" {
+			err = exportBundle(projectRoot, bundle)
+		} else {
+			err = importBundle(projectRoot, bundle)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "audit":
+		os.Exit(runAudit(projectRoot, flag.Args()[1:]))
+	case "fix":
+		os.Exit(runFix(projectRoot, flag.Args()[1:]))
+	case "pin":
+		os.Exit(runPin(projectRoot, flag.Args()[1:]))
+	case "refresh-check":
+		os.Exit(runRefreshCheck(projectRoot, flag.Args()[1:]))
+	case "verify":
+		os.Exit(runVerify(projectRoot, flag.Args()[1:]))
+	}
+
+	var updPaths []string
+	if flag.NArg() > 0 {
+		// explicit .upd files instead of the walk
+		for _, arg := range flag.Args() {
+			if !strings.HasSuffix(arg, ".upd") {
+				fmt.Fprintf(os.Stderr, "Unknown command or not a .upd file: %s\n", arg)
+				flag.Usage()
+				os.Exit(2)
+			}
+			absPath, err := filepath.Abs(arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			updPaths = append(updPaths, absPath)
+		}
+	} else if flagNoWalk {
+		fmt.Fprintf(os.Stderr, "-no-walk requires one or more .upd files as arguments\n")
+		os.Exit(2)
+	} else {
+		updPaths, err = findUpdFiles(projectRoot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+			os.Exit(1)
+		}
+		if flagChangedSince != "" {
+			if updPaths, err = filterChangedSince(projectRoot, updPaths); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if flagPrintConfig {
+		if err := printConfig(projectRoot, env, updPaths); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flagRequireChecksum {
+		if unpinned := findUnpinned(updPaths); len(unpinned) > 0 {
+			fmt.Fprintf(os.Stderr, "-require-checksum: no 'sha256' in:\n")
+			for _, p := range unpinned {
+				fmt.Fprintf(os.Stderr, "  %s\n", p)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if flagWatch {
+		watch(projectRoot, updPaths, flag.NArg() == 0)
+		return
+	}
+
+	summary, abortErr := processUpdFiles(projectRoot, updPaths)
+	if flagProfile {
+		printProfile()
+	}
+	if flagEvictOlderThan > 0 && !flagDryRun {
+		evictOldCacheEntries()
+	}
+	printSummary(summary)
+	printSkippedDownloads()
+	if abortErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", abortErr)
+		os.Exit(1)
+	}
+	if len(summary.Failures) > 0 {
+		os.Exit(1)
+	}
+	if flagDryRun && len(summary.Updated) > 0 {
+		fmt.Fprintf(os.Stderr, "%d file(s) out of date\n", len(summary.Updated))
 		os.Exit(1)
 	}
 }
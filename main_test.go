@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newDirectoryProject returns a project root with an existing out/
+// directory, using a cache of its own, and a server serving files
+func newDirectoryProject(t *testing.T, files map[string][]byte) (string, *httptest.Server) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "out"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := flagCacheDir
+	flagCacheDir = filepath.Join(t.TempDir(), "cache")
+	t.Cleanup(func() { flagCacheDir = old; resetFetchMemo() })
+	resetFetchMemo()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(srv.Close)
+	return root, srv
+}
+
+func writeUpd(t *testing.T, root, name string, lines ...string) string {
+	t.Helper()
+	updPath := filepath.Join(root, name)
+	content := "upd.version: 1\nupd.link: https://github.com/mrvnmyr/upd\n" + strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(updPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return updPath
+}
+
+func TestUpdateFileIntoDirectory(t *testing.T) {
+	root, srv := newDirectoryProject(t, map[string][]byte{"/dl/tool.sh": []byte("echo hi\n")})
+	updPath := writeUpd(t, root, "tool.upd", "url: "+srv.URL+"/dl/tool.sh", "target: out", "directory: true")
+
+	var out fileOutput
+	outcome, err := updateFile(root, updPath, &out)
+	if err != nil || outcome != outcomeUpdated {
+		t.Fatalf("updateFile() = %v, %v, want updated", outcome, err)
+	}
+	written := filepath.Join(root, "out", "tool.sh")
+	if content, err := os.ReadFile(written); err != nil || string(content) != "echo hi\n" {
+		t.Fatalf("%s: %q, %v", written, content, err)
+	}
+	if !strings.Contains(out.stdout.String(), "Updated "+written) {
+		t.Errorf("output %q doesn't report %s", out.stdout.String(), written)
+	}
+
+	out = fileOutput{}
+	if outcome, err := updateFile(root, updPath, &out); err != nil || outcome != outcomeUnchanged {
+		t.Errorf("second updateFile() = %v, %v, want unchanged", outcome, err)
+	}
+}
+
+func TestUpdateFileIntoDirectoryWithoutDirectory(t *testing.T) {
+	root, srv := newDirectoryProject(t, map[string][]byte{"/dl/tool.sh": []byte("echo hi\n")})
+	updPath := writeUpd(t, root, "tool.upd", "url: "+srv.URL+"/dl/tool.sh", "target: out")
+
+	_, err := updateFile(root, updPath, &fileOutput{})
+	if err == nil || !strings.Contains(err.Error(), "is a directory (set 'directory: true'") {
+		t.Fatalf("updateFile() error = %v, want one telling to set 'directory'", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "out")); len(entries) != 0 {
+		t.Errorf("out/ was written to: %v", entries)
+	}
+}
+
+func TestUpdateFileIntoDirectoryExtract(t *testing.T) {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, err := zw.Create("pkg/bin/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("member\n"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root, srv := newDirectoryProject(t, map[string][]byte{"/dl/pkg.zip": archive.Bytes()})
+	updPath := writeUpd(t, root, "tool.upd", "url: "+srv.URL+"/dl/pkg.zip", "extract: pkg/bin/tool", "target: out", "directory: true")
+
+	if _, err := updateFile(root, updPath, &fileOutput{}); err != nil {
+		t.Fatal(err)
+	}
+	// named after the member, not the archive
+	if content, err := os.ReadFile(filepath.Join(root, "out", "tool")); err != nil || string(content) != "member\n" {
+		t.Fatalf("out/tool: %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "out", "pkg.zip")); !os.IsNotExist(err) {
+		t.Errorf("out/pkg.zip written: %v", err)
+	}
+}
+
+func TestUpdateFileIntoDirectoryWithoutFilename(t *testing.T) {
+	root, srv := newDirectoryProject(t, map[string][]byte{"/": []byte("index\n")})
+	updPath := writeUpd(t, root, "index.upd", "url: "+srv.URL+"/", "target: out", "directory: true")
+
+	_, err := updateFile(root, updPath, &fileOutput{})
+	if err == nil || !strings.Contains(err.Error(), "no filename can be derived") {
+		t.Fatalf("updateFile() error = %v, want one about the missing filename", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runPin fetches the content of every .upd file below projectRoot and
+// writes its sha256 into the 'sha256' field of the .upd file, keeping the
+// rest of the file (comments, key order) as is. With -dry-run it only
+// prints what it would pin.
+func runPin(projectRoot string, args []string) int {
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only print what would be pinned")
+	fs.Parse(args)
+
+	updPaths, err := findUpdFiles(projectRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		return 1
+	}
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	os.MkdirAll(cacheDir, 0o755)
+
+	failed := false
+	for _, updPath := range updPaths {
+		if err := pinFile(updPath, cacheDir, *dryRun); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", updPath, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func pinFile(updPath, cacheDir string, dryRun bool) error {
+	upd, err := loadUpdFile(updPath)
+	if err != nil {
+		return err
+	}
+	fr, err := fetchRequestFor(cacheDir, upd)
+	if err != nil {
+		return err
+	}
+	fetched, err := fetchURL(fr)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", upd.URL, err)
+	}
+	var sum string
+	if upd.Extract != "" {
+		archive, err := os.ReadFile(fetched.Path)
+		if err != nil {
+			return err
+		}
+		member, err := extractMember(archive, upd.Extract)
+		if err != nil {
+			return fmt.Errorf("%s: %w", upd.URL, err)
+		}
+		sum = sha256Hex(member)
+	} else if sum, err = fileSha256(fetched.Path); err != nil {
+		return err
+	}
+
+	switch {
+	case strings.EqualFold(upd.Sha256, sum):
+		fmt.Printf("%s already pinned\n", updPath)
+		return nil
+	case dryRun && upd.Sha256 != "":
+		fmt.Printf("Would repin %s: %s -> %s\n", updPath, upd.Sha256, sum)
+		return nil
+	case dryRun:
+		fmt.Printf("Would pin %s: %s\n", updPath, sum)
+		return nil
+	}
+
+	data, err := os.ReadFile(updPath)
+	if err != nil {
+		return err
+	}
+	pinned, err := setYAMLField(data, "sha256", sum)
+	if err != nil {
+		return fmt.Errorf("parsing .upd file: %w", err)
+	}
+	if err := writeFileAtomic(updPath, pinned); err != nil { // keeps its permissions
+		return err
+	}
+	if upd.Sha256 != "" {
+		fmt.Printf("Repinned %s: %s -> %s\n", updPath, upd.Sha256, sum)
+	} else {
+		fmt.Printf("Pinned %s: %s\n", updPath, sum)
+	}
+	return nil
+}
+
+// setYAMLField sets key of the top level mapping of the YAML document data
+// to value, appending "key: value" if it's missing. Only the bytes of the
+// old value are replaced, so the rest of the file is kept as is, down to
+// blank lines and comments.
+func setYAMLField(data []byte, key, value string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("not a YAML mapping")
+	}
+
+	m := doc.Content[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != key {
+			continue
+		}
+		v := m.Content[i+1]
+		if v.Kind != yaml.ScalarNode || v.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+			return nil, fmt.Errorf("'%s' is not a single line value", key)
+		}
+
+		// the value runs from its column up to a comment or the end of the line
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		line := lines[v.Line-1]
+		start := len(string([]rune(string(line))[:v.Column-1]))
+		end := len(bytes.TrimRight(line, "\r\n"))
+		if loc := yamlCommentRegex.FindIndex(line[start:end]); loc != nil {
+			end = start + loc[0]
+		}
+		prefix := line[:start]
+		if bytes.HasSuffix(prefix, []byte(":")) {
+			prefix = append(prefix[:len(prefix):len(prefix)], ' ') // was empty
+		}
+		lines[v.Line-1] = append(append(append([]byte{}, prefix...), value...), line[end:]...)
+		edited := bytes.Join(lines, nil)
+
+		var check map[string]string
+		if err := yaml.Unmarshal(edited, &check); err != nil || check[key] != value {
+			return nil, fmt.Errorf("can't set '%s' in place", key)
+		}
+		return edited, nil
+	}
+
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	return append(data, key+": "+value+"\n"...), nil
+}
+
+// yamlCommentRegex finds a comment following a value on the same line
+var yamlCommentRegex = regexp.MustCompile(`\s+#`)
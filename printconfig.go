@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// effectiveConfig is what -print-config prints: the settings upd would run
+// with after flags, $UPD_ENV, CONFIG_FILE_NAME and its env overlay, includes
+// and defaults have all been applied
+type effectiveConfig struct {
+	ProjectRoot string    `yaml:"projectRoot"`
+	Env         string    `yaml:"env,omitempty"`
+	CacheDir    string    `yaml:"cacheDir"`
+	RemoteCache string    `yaml:"remoteCache,omitempty"`
+	Config      UpdConfig `yaml:"config"`
+
+	Timeouts struct {
+		Connect        time.Duration `yaml:"connect"`
+		TLS            time.Duration `yaml:"tls"`
+		ResponseHeader time.Duration `yaml:"responseHeader"`
+		Overall        time.Duration `yaml:"overall"`
+	} `yaml:"timeouts"`
+	TLSMinVersion    string   `yaml:"tlsMinVersion"`
+	TLSModernCiphers bool     `yaml:"tlsModernCiphers"`
+	DNSServer        string   `yaml:"dnsServer,omitempty"`
+	Jobs             int      `yaml:"jobs"`
+	CompareMode      string   `yaml:"compareMode"`
+	Tags             []string `yaml:"tags,omitempty"`
+
+	Files []effectiveUpdFile `yaml:"files"`
+}
+
+// effectiveUpdFile is where a .upd file is written and cached, plus its
+// fields with its includes merged and values resolved, e.g. 'url' against
+// 'baseURL' and 'compareMode' defaulting to -compare-mode
+type effectiveUpdFile struct {
+	Path      string   `yaml:"path"`
+	Error     string   `yaml:"error,omitempty"`
+	Basefile  string   `yaml:"basefile,omitempty"`
+	CachePath string   `yaml:"cachePath,omitempty"`
+	Selected  bool     `yaml:"selected"` // by -tag
+	Upd       *UpdFile `yaml:"upd,omitempty"`
+}
+
+// printConfig prints the effective configuration for updPaths as YAML
+// (-print-config), fetching and writing nothing
+func printConfig(projectRoot, env string, updPaths []string) error {
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		return err
+	}
+
+	c := effectiveConfig{
+		ProjectRoot:      projectRoot,
+		Env:              env,
+		CacheDir:         cacheDir,
+		RemoteCache:      flagRemoteCache,
+		Config:           config,
+		TLSMinVersion:    flagTLSMinVersion,
+		TLSModernCiphers: flagTLSModernCiphers,
+		DNSServer:        flagDNSServer,
+		Jobs:             flagJobs,
+		CompareMode:      flagCompareMode,
+		Tags:             flagTags,
+		Files:            []effectiveUpdFile{},
+	}
+	c.Config.DefaultHeaders = redactHeaders(config.DefaultHeaders)
+	c.Timeouts.Connect = flagConnectTimeout
+	c.Timeouts.TLS = flagTLSTimeout
+	c.Timeouts.ResponseHeader = flagResponseHeaderTimeout
+	c.Timeouts.Overall = flagTimeout
+
+	for _, updPath := range updPaths {
+		f := effectiveUpdFile{Path: updPath}
+		upd, err := loadUpdFile(updPath)
+		if err != nil {
+			f.Error = err.Error()
+			c.Files = append(c.Files, f)
+			continue
+		}
+		upd.Include = nil // already merged in
+		upd.Headers = redactHeaders(upd.Headers)
+		upd.CompareMode = compareModeFor(upd)
+		f.Upd = &upd
+		if f.Basefile, err = basefileFor(updPath, upd); err != nil {
+			f.Error = err.Error()
+		}
+		fr := FetchRequest{URL: upd.URL, UnixSocket: upd.UnixSocket}
+		f.CachePath = cachePathFor(cacheDir, fr.cacheKey())
+		f.Selected = matchesTagFilter(upd.Tags, flagTags)
+		c.Files = append(c.Files, f)
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return fmt.Errorf("printing config: %w", err)
+	}
+	return enc.Close()
+}
+
+// redactHeaders returns headers with their values replaced, they may well
+// hold credentials
+func redactHeaders(headers map[string]string) map[string]string {
+	redacted := map[string]string{}
+	for name := range headers {
+		redacted[name] = "<redacted>"
+	}
+	return redacted
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// phaseTimings is where the time of processing a single .upd file went,
+// recorded with -profile
+type phaseTimings struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration // from having sent the request to the first response byte
+	Download  time.Duration // reading the body
+	Compare   time.Duration
+	Write     time.Duration
+}
+
+func (t *phaseTimings) add(o phaseTimings) {
+	t.DNS += o.DNS
+	t.Connect += o.Connect
+	t.TLS += o.TLS
+	t.FirstByte += o.FirstByte
+	t.Download += o.Download
+	t.Compare += o.Compare
+	t.Write += o.Write
+}
+
+// withTrace returns ctx with an httptrace filling the network phases of t.
+// The callbacks may run concurrently, e.g. the Connect ones of the dials
+// racing for IPv4 and IPv6, so they take turns.
+func (t *phaseTimings) withTrace(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	var dnsStart, tlsStart, wroteRequest time.Time
+	connectStart := map[string]time.Time{}
+	locked := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { locked(func() { dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { locked(func() { t.DNS += time.Since(dnsStart) }) },
+		ConnectStart: func(network, addr string) {
+			locked(func() { connectStart[network+" "+addr] = time.Now() })
+		},
+		ConnectDone: func(network, addr string, _ error) {
+			locked(func() { t.Connect += time.Since(connectStart[network+" "+addr]) })
+		},
+		TLSHandshakeStart: func() { locked(func() { tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { t.TLS += time.Since(tlsStart) })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { locked(func() { wroteRequest = time.Now() }) },
+		GotFirstResponseByte: func() {
+			locked(func() { t.FirstByte += time.Since(wroteRequest) })
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+type profileRecord struct {
+	File    string
+	Timings phaseTimings
+}
+
+var (
+	profileMu      sync.Mutex
+	profileRecords []profileRecord
+)
+
+func recordProfile(file string, t phaseTimings) {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	profileRecords = append(profileRecords, profileRecord{File: file, Timings: t})
+}
+
+// printProfile prints a table of all recorded timings plus their total
+func printProfile() {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+	}
+	row := func(w *tabwriter.Writer, name string, t phaseTimings) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name,
+			ms(t.DNS), ms(t.Connect), ms(t.TLS), ms(t.FirstByte), ms(t.Download), ms(t.Compare), ms(t.Write))
+	}
+
+	var total phaseTimings
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	slices.SortFunc(profileRecords, func(a, b profileRecord) int { return strings.Compare(a.File, b.File) })
+	fmt.Fprintf(w, "FILE\tDNS\tCONNECT\tTLS\tFIRST BYTE\tDOWNLOAD\tCOMPARE\tWRITE\n")
+	for _, r := range profileRecords {
+		row(w, r.File, r.Timings)
+		total.add(r.Timings)
+	}
+	row(w, "TOTAL", total)
+	w.Flush()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A range-hash manifest lets large files be updated by only downloading the
+// chunks that changed. It's a JSON document next to the file upstream,
+// referenced by the 'rangeHashes' field of a .upd file:
+//
+//	{
+//	  "chunkSize": 1048576,
+//	  "size": 5242880,
+//	  "sha256": "<hex sha256 of the whole file, optional>",
+//	  "chunks": ["<hex sha256 of bytes 0..chunkSize-1>", ...]
+//	}
+//
+// Every chunk but the last is exactly chunkSize bytes, which must not be
+// more than 8 MiB. Chunks of the local copy (the cached body, else the
+// basefile) whose hash matches are reused, the others are fetched via Range
+// requests. Whenever the manifest can't be fetched or the server doesn't
+// honor ranges, upd falls back to a full fetch.
+
+// rangeManifest is the content of a range-hash manifest
+type rangeManifest struct {
+	ChunkSize int64    `json:"chunkSize"`
+	Size      int64    `json:"size"`
+	Sha256    string   `json:"sha256"`
+	Chunks    []string `json:"chunks"`
+}
+
+// rangeMaxChunkSize caps the chunkSize of a manifest, a chunk is held in
+// memory while it's hashed
+const rangeMaxChunkSize = 8 << 20
+
+// errRangesUnsupported means the server answered a Range request with
+// something other than the requested range
+var errRangesUnsupported = errors.New("server does not support range requests")
+
+// fetchWithRangeHashes assembles the body of fr from unchanged local chunks
+// plus the changed ones fetched from upstream and commits it to the cache
+func fetchWithRangeHashes(fr FetchRequest) (FetchResult, error) {
+	client := newHTTPClient(fr)
+
+	manifest, err := fetchRangeManifest(client, fr)
+	if err != nil {
+		return FetchResult{}, err
+	}
+
+	cachePath := cachePathFor(fr.CacheDir, fr.cacheKey())
+	metaPath := cachePath + ".meta"
+	markCacheUsed(cachePath)
+	var meta cacheMeta
+	if !flagNoMeta {
+		meta, _ = readCacheMeta(metaPath)
+	}
+	contentAddressed := flagContentAddressed && !flagNoMeta
+
+	// prefer the cached body, it's the unmodified upstream content
+	var local *os.File
+	for _, p := range []string{cacheBodyPath(fr.CacheDir, cachePath, meta), fr.RangeSeed} {
+		if f, err := os.Open(p); err == nil {
+			local = f
+			break
+		}
+	}
+	if local != nil {
+		defer local.Close()
+	}
+
+	tmp, err := os.CreateTemp(fr.CacheDir, ".tmp-*")
+	if err != nil {
+		return FetchResult{}, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once committed
+	defer tmp.Close()
+
+	// find the runs of changed chunks, each is fetched with one request
+	type chunkRun struct{ first, last int }
+	var runs []chunkRun
+	buf := make([]byte, manifest.ChunkSize)
+	for i, want := range manifest.Chunks {
+		chunk := buf[:manifest.chunkLen(i)]
+		if local != nil && readChunk(local, chunk, int64(i)*manifest.ChunkSize) && strings.EqualFold(sha256Hex(chunk), want) {
+			if _, err := tmp.WriteAt(chunk, int64(i)*manifest.ChunkSize); err != nil {
+				return FetchResult{}, err
+			}
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].last == i-1 {
+			runs[n-1].last = i
+		} else {
+			runs = append(runs, chunkRun{i, i})
+		}
+	}
+
+	var fetchSize int64
+	for _, r := range runs {
+		for i := r.first; i <= r.last; i++ {
+			fetchSize += manifest.chunkLen(i)
+		}
+	}
+	if err := checkDownloadSize(fr.URL, fetchSize); err != nil {
+		return FetchResult{}, err
+	}
+
+	var fetchedChunks int
+	for _, r := range runs {
+		if err := fetchChunkRange(client, fr, manifest, r.first, r.last, tmp); err != nil {
+			return FetchResult{}, err
+		}
+		fetchedChunks += r.last - r.first + 1
+	}
+	verbosef("%s: fetched %d of %d chunks\n", fr.URL, fetchedChunks, len(manifest.Chunks))
+
+	if err := tmp.Truncate(manifest.Size); err != nil {
+		return FetchResult{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return FetchResult{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, tmp); err != nil {
+		return FetchResult{}, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if manifest.Sha256 != "" && !strings.EqualFold(sum, manifest.Sha256) {
+		return FetchResult{}, fmt.Errorf("assembled %s has sha256 %s, manifest says %s", fr.URL, sum, manifest.Sha256)
+	}
+	if err := tmp.Close(); err != nil {
+		return FetchResult{}, err
+	}
+
+	bodyPath, err := commitCacheBody(fr.CacheDir, cachePath, tmp.Name(), sum, contentAddressed)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	if bodyPath != cachePath {
+		os.Remove(cachePath) // superseded by the content-addressed body
+	}
+	if !flagNoMeta {
+		_ = writeCacheMeta(metaPath, cacheMeta{URL: fr.URL, BodySha256: sum, FetchedAt: time.Now()})
+	}
+	reason := fmt.Sprintf("range-hash manifest, fetched %d of %d chunks into %s", fetchedChunks, len(manifest.Chunks), bodyPath)
+	return FetchResult{Path: bodyPath, CacheHit: fetchedChunks == 0, Reason: reason}, nil
+}
+
+// chunkLen is the length of chunk i, only the last one may be shorter
+func (m rangeManifest) chunkLen(i int) int64 {
+	return min(m.ChunkSize, m.Size-int64(i)*m.ChunkSize)
+}
+
+func fetchRangeManifest(client *http.Client, fr FetchRequest) (rangeManifest, error) {
+	var m rangeManifest
+
+	req, err := http.NewRequest("GET", fr.RangeHashes, nil)
+	if err != nil {
+		return m, err
+	}
+	for k, v := range fr.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("fetching range-hash manifest %s: %s", fr.RangeHashes, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return m, fmt.Errorf("parsing range-hash manifest %s: %w", fr.RangeHashes, err)
+	}
+
+	if m.ChunkSize <= 0 || m.Size < 0 {
+		return m, fmt.Errorf("range-hash manifest %s: invalid chunkSize/size", fr.RangeHashes)
+	}
+	if m.ChunkSize > rangeMaxChunkSize {
+		return m, fmt.Errorf("range-hash manifest %s: chunkSize %d exceeds the maximum of %d", fr.RangeHashes, m.ChunkSize, rangeMaxChunkSize)
+	}
+	if want := (m.Size + m.ChunkSize - 1) / m.ChunkSize; int64(len(m.Chunks)) != want {
+		return m, fmt.Errorf("range-hash manifest %s: %d chunks listed, size needs %d", fr.RangeHashes, len(m.Chunks), want)
+	}
+	return m, nil
+}
+
+// fetchChunkRange fetches chunks first..last with a single Range request,
+// verifies them against the manifest and writes them into dst
+func fetchChunkRange(client *http.Client, fr FetchRequest, m rangeManifest, first, last int, dst *os.File) error {
+	start := int64(first) * m.ChunkSize
+	end := start + int64(last-first)*m.ChunkSize + m.chunkLen(last) - 1
+
+	req, err := http.NewRequest("GET", fr.URL, nil)
+	if err != nil {
+		return err
+	}
+	if fr.Timings != nil {
+		req = req.WithContext(fr.Timings.withTrace(req.Context()))
+	}
+	for k, v := range fr.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return errRangesUnsupported
+	}
+
+	buf := make([]byte, m.ChunkSize)
+	for i := first; i <= last; i++ {
+		chunk := buf[:m.chunkLen(i)]
+		if _, err := io.ReadFull(resp.Body, chunk); err != nil {
+			return fmt.Errorf("reading chunk %d: %w", i, err)
+		}
+		if sum := sha256Hex(chunk); !strings.EqualFold(sum, m.Chunks[i]) {
+			return fmt.Errorf("chunk %d has sha256 %s, manifest says %s", i, sum, m.Chunks[i])
+		}
+		if _, err := dst.WriteAt(chunk, int64(i)*m.ChunkSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunk fills chunk from f at off, false if f is too short
+func readChunk(f *os.File, chunk []byte, off int64) bool {
+	n, err := f.ReadAt(chunk, off)
+	return n == len(chunk) && (err == nil || err == io.EOF)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
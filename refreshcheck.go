@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// runRefreshCheck tells for every .upd file below projectRoot whether
+// upstream moved since it was cached: it fetches each URL afresh into a
+// temporary directory and compares that with the cache entry. Neither
+// basefiles nor the persistent cache are touched.
+func runRefreshCheck(projectRoot string, args []string) int {
+	fs := flag.NewFlagSet("refresh-check", flag.ExitOnError)
+	fs.Parse(args)
+
+	updPaths, err := findUpdFiles(projectRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		return 1
+	}
+	cacheDir, err := defaultCacheDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	tmpDir, err := os.MkdirTemp("", "upd-refresh-check-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// only upstream counts here, and nothing must be pushed anywhere
+	flagRemoteCache = ""
+
+	var changed, unchanged, failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "FILE\tUPSTREAM\n")
+	for _, updPath := range updPaths {
+		rel, err := filepath.Rel(projectRoot, updPath)
+		if err != nil {
+			rel = updPath
+		}
+		status, err := refreshCheckFile(updPath, cacheDir, tmpDir)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "%s\terror\t%v\n", rel, err)
+			failed++
+			continue
+		case status == "changed":
+			changed++
+		case status == "unchanged":
+			unchanged++
+		}
+		fmt.Fprintf(w, "%s\t%s\n", rel, status)
+	}
+	w.Flush()
+	fmt.Printf("%d changed, %d unchanged, %d failed\n", changed, unchanged, failed)
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// refreshCheckFile returns "changed", "unchanged" or, if there's nothing
+// to compare with, "not cached" for the .upd file at updPath
+func refreshCheckFile(updPath, cacheDir, tmpDir string) (string, error) {
+	upd, err := loadUpdFile(updPath)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(upd.URL)
+	if err != nil {
+		return "", err
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return "not cached", nil // only http(s) bodies are cached
+	}
+
+	fr, err := fetchRequestFor(cacheDir, upd)
+	if err != nil {
+		return "", err
+	}
+
+	cachePath := cachePathFor(cacheDir, fr.cacheKey())
+	meta, _ := readCacheMeta(cachePath + ".meta")
+	cachedSum, err := fileSha256(cacheBodyPath(cacheDir, cachePath, meta))
+	if err != nil {
+		return "not cached", nil
+	}
+
+	// a fresh cache dir, so a plain (unconditional) GET of the whole body
+	fresh := fr
+	fresh.CacheDir, err = os.MkdirTemp(tmpDir, "")
+	if err != nil {
+		return "", err
+	}
+	fresh.RangeHashes = ""
+	fetched, err := fetchURL(fresh)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %w", upd.URL, err)
+	}
+	freshSum, err := fileSha256(fetched.Path)
+	if err != nil {
+		return "", err
+	}
+
+	if freshSum == cachedSum {
+		return "unchanged", nil
+	}
+	return "changed", nil
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A remote cache is a plain HTTP server shared by a team: on a local cache
+// miss upd first tries GET <remote>/<cache file name> (plus .meta) before
+// going upstream, and with -cache-push it PUTs freshly fetched bodies there.
+// It's strictly best effort, any error just means going upstream.
+
+// remoteCacheURL returns the remote cache URL of the local cache file cachePath
+func remoteCacheURL(cachePath string) string {
+	return strings.TrimRight(flagRemoteCache, "/") + "/" + filepath.Base(cachePath)
+}
+
+// fetchFromRemoteCache tries to fill the local cache entry at cachePath from
+// the remote cache, returning the local body path on success
+func fetchFromRemoteCache(fr FetchRequest, cachePath, metaPath string) (string, bool) {
+	client := newHTTPClient(FetchRequest{URL: flagRemoteCache})
+	remote := remoteCacheURL(cachePath)
+
+	resp, err := client.Get(remote)
+	if err != nil {
+		verbosef("remote cache: %v\n", err)
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		verbosef("remote cache: GET %s: %s\n", remote, resp.Status)
+		return "", false
+	}
+
+	bodyPath, sum, err := storeCacheBody(fr.CacheDir, cachePath, resp.Body, flagContentAddressed)
+	if err != nil {
+		verbosef("remote cache: storing %s: %v\n", remote, err)
+		return "", false
+	}
+
+	// the upstream validators, so the next run can do a conditional GET
+	meta := cacheMeta{URL: fr.URL}
+	if metaResp, err := client.Get(remote + ".meta"); err == nil {
+		if data, err := io.ReadAll(metaResp.Body); err == nil && metaResp.StatusCode == http.StatusOK {
+			meta = parseCacheMeta(data)
+		}
+		metaResp.Body.Close()
+	}
+	meta.URL = fr.URL
+	meta.BodySha256 = sum
+	meta.FetchedAt = time.Now()
+	_ = writeCacheMeta(metaPath, meta)
+
+	verbosef("remote cache: hit for %s\n", fr.URL)
+	return bodyPath, true
+}
+
+// pushToRemoteCache uploads the local cache entry (body at bodyPath, meta at
+// metaPath) of cachePath to the remote cache
+func pushToRemoteCache(cachePath, bodyPath, metaPath string) {
+	client := newHTTPClient(FetchRequest{URL: flagRemoteCache})
+	remote := remoteCacheURL(cachePath)
+
+	put := func(url, path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("PUT %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+
+	if err := put(remote, bodyPath); err != nil {
+		verbosef("remote cache: push failed: %v\n", err)
+		return
+	}
+	if err := put(remote+".meta", metaPath); err != nil {
+		verbosef("remote cache: push failed: %v\n", err)
+		return
+	}
+	verbosef("remote cache: pushed %s\n", remote)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryMaxDelay caps how long a single retry waits, including what a
+// Retry-After header asks for
+const retryMaxDelay = time.Minute
+
+// doWithRetries sends req with client, making up to -attempts attempts while
+// the request fails transiently: connection errors and timeouts, or a 429 or
+// 5xx response. The wait doubles from -retry-delay with each attempt, unless
+// the response says how long to wait via Retry-After. What the last attempt
+// returned is returned as is, so it's up to the caller to fall back to the
+// cache or report the status.
+func doWithRetries(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= flagAttempts {
+			return resp, err
+		}
+
+		delay := flagRetryDelay << (attempt - 1)
+		var failure string
+		switch {
+		case err != nil:
+			if !isTransientError(req.URL.Hostname(), err) {
+				return resp, err
+			}
+			failure = err.Error()
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = after
+			}
+			resp.Body.Close()
+			failure = resp.Status
+		default:
+			return resp, nil
+		}
+		delay = min(delay, retryMaxDelay)
+		verbosef("%s: %s, retrying in %s (attempt %d of %d)\n", req.URL, failure, delay, attempt+1, flagAttempts)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransientError tells whether a failed request to host may well succeed
+// when simply tried again. Hosts that don't exist, certificates that don't
+// verify, TLS policy mismatches and requests missing from a -replay
+// recording won't change by then.
+func isTransientError(host string, err error) bool {
+	if errors.Is(err, errNotRecorded) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
+	}
+	return tlsPolicyError(host, err) == nil
+}
+
+// parseRetryAfter parses a Retry-After header, either in seconds or an
+// HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(0, time.Until(t)), true
+	}
+	return 0, false
+}
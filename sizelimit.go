@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// downloadTooLargeError is returned when a download exceeds
+// -max-download-size, the file is skipped rather than failed
+type downloadTooLargeError struct {
+	URL     string
+	Size    int64
+	AtLeast bool // Size is a lower bound, the actual size is unknown
+}
+
+func (e *downloadTooLargeError) Error() string {
+	if e.AtLeast {
+		return fmt.Sprintf("%s is larger than -max-download-size %d", e.URL, flagMaxDownloadSize)
+	}
+	return fmt.Sprintf("%s is %d bytes, above -max-download-size %d", e.URL, e.Size, flagMaxDownloadSize)
+}
+
+// skipped because of -max-download-size, reported at the end of the run
+var (
+	skippedDownloads       atomic.Int64
+	skippedDownloadBytes   atomic.Int64
+	skippedDownloadAtLeast atomic.Bool
+)
+
+// recordSkippedDownload counts e for the report at the end of the run
+func recordSkippedDownload(e *downloadTooLargeError) {
+	skippedDownloads.Add(1)
+	skippedDownloadBytes.Add(e.Size)
+	if e.AtLeast {
+		skippedDownloadAtLeast.Store(true)
+	}
+}
+
+// printSkippedDownloads reports what was skipped because of -max-download-size
+func printSkippedDownloads() {
+	n := skippedDownloads.Load()
+	if n == 0 {
+		return
+	}
+	atLeast := ""
+	if skippedDownloadAtLeast.Load() {
+		atLeast = " at least"
+	}
+	fmt.Printf("Skipped %d file(s) above -max-download-size,%s %d bytes in total\n", n, atLeast, skippedDownloadBytes.Load())
+}
+
+// checkDownloadSize fails with a downloadTooLargeError if -max-download-size
+// is set and size is above it, size -1 is unknown
+func checkDownloadSize(url string, size int64) error {
+	if flagMaxDownloadSize > 0 && size > flagMaxDownloadSize {
+		return &downloadTooLargeError{URL: url, Size: size}
+	}
+	return nil
+}
+
+// limitDownload wraps body so reading more than -max-download-size from it
+// fails with a downloadTooLargeError, for responses without Content-Length
+func limitDownload(url string, body io.Reader) io.Reader {
+	if flagMaxDownloadSize <= 0 {
+		return body
+	}
+	return &sizeLimitedReader{url: url, r: body, left: flagMaxDownloadSize}
+}
+
+type sizeLimitedReader struct {
+	url  string
+	r    io.Reader
+	left int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, &downloadTooLargeError{URL: l.url, Size: flagMaxDownloadSize + 1, AtLeast: true}
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1] // one more byte tells whether it's too large
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, &downloadTooLargeError{URL: l.url, Size: flagMaxDownloadSize + 1, AtLeast: true}
+	}
+	return n, err
+}
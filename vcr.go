@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// -record saves every HTTP response into a directory, -replay serves them
+// from there instead of the network, e.g. for tests and demos. Responses are
+// keyed by what identifies a cache entry (see FetchRequest.cacheKey) plus the
+// method and Range header. Requests are recorded without conditional headers,
+// so a recording replays the same no matter the state of the cache.
+
+// recordedResponse is a single response saved by -record
+type recordedResponse struct {
+	Key        string      `json:"key"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// recordingKey identifies req made for the FetchRequest with cache key cacheKey
+func recordingKey(req *http.Request, cacheKey string) string {
+	key := req.Method + " " + cacheKey
+	if r := req.Header.Get("Range"); r != "" {
+		key += " " + r
+	}
+	return key
+}
+
+func recordingPath(dir, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// recordingTransport saves all responses of next into dir
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+	fr   FetchRequest
+}
+
+// keyFor returns the recording key of req, which is fr.cacheKey for req.URL
+func keyFor(fr FetchRequest, req *http.Request) string {
+	fr.URL = req.URL.String()
+	return recordingKey(req, fr.cacheKey())
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec := recordedResponse{Key: keyFor(t.fr, req), StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(recordingPath(t.dir, rec.Key), append(data, '\n'), 0o644); err != nil {
+		return nil, fmt.Errorf("recording %s: %w", rec.Key, err)
+	}
+	verbosef("recorded %s\n", rec.Key)
+	return resp, nil
+}
+
+// errNotRecorded is returned under -replay for a request that isn't in the
+// recording, asking again won't make it appear
+var errNotRecorded = errors.New("no recorded response")
+
+// replayTransport answers requests from a recording in dir
+type replayTransport struct {
+	dir string
+	fr  FetchRequest
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := keyFor(t.fr, req)
+	data, err := os.ReadFile(recordingPath(t.dir, key))
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s in %s", errNotRecorded, key, t.dir)
+	}
+	var rec recordedResponse
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parsing recorded response for %s: %w", key, err)
+	}
+
+	// let net/http fill in what a real response has, e.g. Status
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "HTTP/1.1 %d %s\r\n", rec.StatusCode, http.StatusText(rec.StatusCode))
+	rec.Header.Del("Transfer-Encoding")
+	rec.Header.Set("Content-Length", fmt.Sprint(len(rec.Body)))
+	rec.Header.Write(&raw)
+	raw.WriteString("\r\n")
+	raw.Write(rec.Body)
+	verbosef("replayed %s\n", key)
+	return http.ReadResponse(bufio.NewReader(&raw), req)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// runVerify checks, without any network access, that every basefile below
+// projectRoot still has the content its .upd file pins via 'sha256'. It
+// catches local edits and forgotten regenerations, e.g. as a pre-commit
+// check. Only -offline is supported for now, the recorded pins are the only
+// expected hashes there are.
+func runVerify(projectRoot string, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	offline := fs.Bool("offline", false, "Compare basefiles with their pinned sha256 only, without fetching anything")
+	fs.Parse(args)
+
+	if !*offline {
+		fmt.Fprintf(os.Stderr, "verify requires -offline\n")
+		return 2
+	}
+
+	updPaths, err := findUpdFiles(projectRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+		return 1
+	}
+	if flagChangedSince != "" {
+		if updPaths, err = filterChangedSince(projectRoot, updPaths); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	var ok, drifted, skipped, failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "FILE\tSTATUS\n")
+	for _, updPath := range updPaths {
+		rel, err := filepath.Rel(projectRoot, updPath)
+		if err != nil {
+			rel = updPath
+		}
+		status, detail, err := verifyFileOffline(updPath)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "%s\terror\t%v\n", rel, err)
+			failed++
+			continue
+		case status == "ok":
+			ok++
+		case status == "drift" || status == "missing":
+			drifted++
+		default:
+			skipped++
+		}
+		if detail != "" {
+			status += "\t" + detail
+		}
+		fmt.Fprintf(w, "%s\t%s\n", rel, status)
+	}
+	w.Flush()
+	fmt.Printf("%d ok, %d drifted, %d skipped, %d failed\n", ok, drifted, skipped, failed)
+
+	if drifted > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyFileOffline returns "ok", "drift" or "missing" for the basefile of
+// the .upd file at updPath, or why it can't be verified: "not pinned", "not
+// selected" by -tag or 'goVersionConstraint' or "unverifiable", as the pin
+// is of the upstream body and with the settings updateFile runs with
+// (including -strip-bom and -compare-mode) the basefile may legitimately
+// differ from it
+func verifyFileOffline(updPath string) (status, detail string, err error) {
+	upd, err := loadUpdFile(updPath)
+	if err != nil {
+		return "", "", err
+	}
+	basefile, err := basefileFor(updPath, upd)
+	if err != nil {
+		return "", "", err
+	}
+
+	if upd.GoVersionConstraint != "" {
+		version, err := currentGoVersion()
+		if err != nil {
+			return "", "", err
+		}
+		ok, err := satisfiesVersionConstraint(version, upd.GoVersionConstraint)
+		if err != nil {
+			return "", "", fmt.Errorf("parsing 'goVersionConstraint': %w", err)
+		}
+		if !ok {
+			return "not selected", fmt.Sprintf("requires go %s (have %s)", upd.GoVersionConstraint, version), nil
+		}
+	}
+
+	switch {
+	case !matchesTagFilter(upd.Tags, flagTags):
+		return "not selected", "", nil
+	case upd.Sha256 == "":
+		return "not pinned", "", nil
+	case stripsBOM(upd) || upd.JSONPath != "" || upd.Header != nil:
+		return "unverifiable", "content is transformed before writing", nil
+	case upd.IgnoreLines != "" || upd.IgnoreHeaderLines > 0 || compareModeFor(upd) == compareSemantic:
+		return "unverifiable", "equivalent content is kept as is", nil
+	case upd.ManualReview:
+		return "unverifiable", "changes are applied by hand", nil
+	}
+
+	sum, err := fileSha256(basefile)
+	if os.IsNotExist(err) {
+		return "missing", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.EqualFold(sum, upd.Sha256) {
+		return "drift", fmt.Sprintf("expected sha256 %s, found %s", upd.Sha256, sum), nil
+	}
+	return "ok", "", nil
+}
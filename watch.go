@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchMaxBackoff caps how long -watch waits between syncs while files fail
+const watchMaxBackoff = 10 * time.Minute
+
+// watch syncs updPaths over and over (-watch) until SIGINT/SIGTERM: every
+// -interval, or as soon as one of the .upd files changes. With walk the
+// project is searched for .upd files again before each sync. While files
+// fail the wait doubles (up to watchMaxBackoff), so upstreams that are
+// having trouble aren't hammered. Unchanged files aren't fetched again
+// unless upstream says so, thanks to the conditional GETs of the cache.
+func watch(projectRoot string, updPaths []string, walk bool) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	wait := flagWatchInterval
+	for {
+		if walk {
+			found, err := findUpdFiles(projectRoot)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Walk error: %v\n", err)
+			} else {
+				updPaths = found
+			}
+		}
+
+		resetFetchMemo()
+		summary, err := processUpdFiles(projectRoot, updPaths)
+		failed := len(summary.Failures)
+		if flagSummaryOnly && (len(summary.Updated) > 0 || failed > 0) {
+			printSummary(summary)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err) // keeps watching all the same
+		}
+		if failed > 0 {
+			wait = min(2*wait, watchMaxBackoff)
+			verbosef("%d file(s) failed, next sync in %s\n", failed, wait)
+		} else {
+			wait = flagWatchInterval
+		}
+
+		if !waitForChange(ctx, projectRoot, updPaths, walk, wait) {
+			if flagProfile {
+				printProfile()
+			}
+			return
+		}
+	}
+}
+
+// waitForChange waits for d to pass or one of updPaths (or with walk the set
+// of .upd files) to change, false once ctx is done
+func waitForChange(ctx context.Context, projectRoot string, updPaths []string, walk bool, d time.Duration) bool {
+	before := updModTimes(updPaths)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-poll.C:
+			current := updPaths
+			if walk {
+				if found, err := findUpdFiles(projectRoot); err == nil {
+					current = found
+				}
+			}
+			if after := updModTimes(current); !sameModTimes(before, after) {
+				verbosef("a .upd file changed, syncing\n")
+				return true
+			}
+		}
+	}
+}
+
+// updModTimes returns the modification times of paths, missing ones are zero
+func updModTimes(paths []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			times[p] = info.ModTime()
+		} else {
+			times[p] = time.Time{}
+		}
+	}
+	return times
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, t := range a {
+		if u, ok := b[p]; !ok || !t.Equal(u) {
+			return false
+		}
+	}
+	return true
+}